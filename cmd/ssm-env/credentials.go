@@ -0,0 +1,34 @@
+// Copyright © 2020 Peter Wilson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/sirupsen/logrus"
+)
+
+// ssmClientConfig returns the config of the SSM client. With a role ARN, set by the webhook from
+// SSM_ROLE_ARN or the role-arn annotation, parameters are read with the credentials of the role
+// assumed with the pod credentials, otherwise with the pod credentials as they are
+func ssmClientConfig(provider client.ConfigProvider, region, roleARN string, logger logrus.FieldLogger) *aws.Config {
+	config := aws.NewConfig().WithRegion(region)
+	if roleARN != "" {
+		logger.Infoln("assuming role:", roleARN)
+		config = config.WithCredentials(stscreds.NewCredentials(provider, roleARN))
+	}
+	return config
+}
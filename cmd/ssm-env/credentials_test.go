@@ -0,0 +1,52 @@
+// Copyright © 2020 Peter Wilson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func Test_ssmClientConfig(t *testing.T) {
+	sess, err := session.NewSession(aws.NewConfig().WithRegion("eu-west-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name            string
+		roleARN         string
+		wantCredentials bool
+	}{
+		{name: "pod credentials"},
+		{name: "assumed role", roleARN: "arn:aws:iam::123456789012:role/team-a", wantCredentials: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger, _ := test.NewNullLogger()
+			config := ssmClientConfig(sess, "eu-west-1", tt.roleARN, logger)
+			if got := aws.StringValue(config.Region); got != "eu-west-1" {
+				t.Errorf("ssmClientConfig() region = %v, want %v", got, "eu-west-1")
+			}
+			if got := config.Credentials != nil; got != tt.wantCredentials {
+				t.Errorf("ssmClientConfig() credentials set = %v, want %v", got, tt.wantCredentials)
+			}
+		})
+	}
+}
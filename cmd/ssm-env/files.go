@@ -0,0 +1,50 @@
+// Copyright © 2020 Peter Wilson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+
+	"emperror.dev/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// fileInjector returns an injector writing values read from ssm to files in dir and setting the
+// variables to their paths, so the values don't end up in the environment of the process.
+// With fileMode false only the variables with the fileMode option are written to files
+func fileInjector(dir string, fileMode bool, options map[string]variableOptions, inject secretInjectorFunc, logger logrus.FieldLogger) (secretInjectorFunc, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.WrapIf(err, "failed to create secret file directory")
+	}
+
+	return func(key, value string) {
+		toFile := fileMode
+		if option := options[key].FileMode; option != nil {
+			toFile = *option
+		}
+		if !toFile {
+			inject(key, value)
+			return
+		}
+		file := filepath.Join(dir, key)
+		// the file is left over when the container restarts, and exec handlers rewrite it
+		// while the process reads it
+		if err := writeFileAtomic(file, []byte(value), 0400); err != nil {
+			logger.Fatalln("failed to write secret file", file, err.Error())
+		}
+		inject(key, file)
+	}, nil
+}
@@ -0,0 +1,90 @@
+// Copyright © 2020 Peter Wilson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	cmp "github.com/google/go-cmp/cmp"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func Test_fileInjector(t *testing.T) {
+	toFile, toEnv := true, false
+
+	tests := []struct {
+		name      string
+		fileMode  bool
+		options   map[string]variableOptions
+		wantFiles []string
+	}{
+		{name: "file mode", fileMode: true, wantFiles: []string{"API_TOKEN", "DB_PASSWORD"}},
+		{
+			name:      "file mode with an opt-out",
+			fileMode:  true,
+			options:   map[string]variableOptions{"API_TOKEN": {FileMode: &toEnv}},
+			wantFiles: []string{"DB_PASSWORD"},
+		},
+		{
+			name:      "fileMode option only",
+			options:   map[string]variableOptions{"API_TOKEN": {FileMode: &toFile}},
+			wantFiles: []string{"API_TOKEN"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmp, err := ioutil.TempDir("", "ssm-env")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmp)
+			dir := filepath.Join(tmp, "app")
+
+			environ := map[string]string{}
+			logger, _ := test.NewNullLogger()
+			injectSecret, err := fileInjector(dir, tt.fileMode, tt.options, func(key, value string) { environ[key] = value }, logger)
+			if err != nil {
+				t.Fatalf("fileInjector() error = %v", err)
+			}
+			values := map[string]string{"API_TOKEN": "token", "DB_PASSWORD": "password"}
+			for key, value := range values {
+				injectSecret(key, value)
+			}
+
+			var gotFiles []string
+			for _, key := range []string{"API_TOKEN", "DB_PASSWORD"} {
+				if environ[key] == values[key] {
+					continue
+				}
+				if environ[key] != filepath.Join(dir, key) {
+					t.Errorf("fileInjector() %s = %v, want the value or its file", key, environ[key])
+					continue
+				}
+				content, err := ioutil.ReadFile(environ[key])
+				if err != nil || string(content) != values[key] {
+					t.Errorf("fileInjector() %s file = %q, %v, want %q", key, content, err, values[key])
+				}
+				gotFiles = append(gotFiles, key)
+			}
+			if !cmp.Equal(gotFiles, tt.wantFiles) {
+				t.Errorf("fileInjector() files diff %v", cmp.Diff(gotFiles, tt.wantFiles))
+			}
+		})
+	}
+}
@@ -19,20 +19,80 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"regexp"
 	"strings"
 	"syscall"
+	"time"
 
 	"emperror.dev/errors"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cast"
 )
 
+// pathVariable is a ${VAR} reference to the environment in a parameter path
+var pathVariable = regexp.MustCompile(`\$\{([^{}]*)\}`)
+
+// execHandlerArg tells ssm-env it runs an exec probe or lifecycle hook of the container
+const execHandlerArg = "--exec-handler"
+
+// execProcess replaces ssm-env with the process
+var execProcess = syscall.Exec
+
+// envSuffix is the suffix of the variables set for ssm-env by its webhook, see ssmEnvSuffix
+var envSuffix string
+
+// ssmEnvSuffix returns the suffix of the variables of the webhook from the directory it mounted
+// ssm-env in: none for /mutate/, _SSM_EU for /mutate-ssm-eu/ of the reference prefix ssm-eu:.
+// Webhooks using different prefixes wrap the same container with their ssm-env one inside the
+// other, each ssm-env reads the variables of its own webhook
+func ssmEnvSuffix(executable string) string {
+	dir := filepath.Base(filepath.Dir(executable))
+	if !strings.HasPrefix(dir, "mutate-") {
+		return ""
+	}
+	return "_" + strings.ToUpper(strings.Replace(strings.TrimPrefix(dir, "mutate-"), "-", "_", -1))
+}
+
+// getenv returns a variable set for ssm-env by its webhook
+func getenv(name string) string {
+	return os.Getenv(name + envSuffix)
+}
+
+// referencePrefix marks the values that are ssm references, SSM_REFERENCE_PREFIX or ssm: by
+// default. The prefix followed by ":" escapes a value starting with the prefix, which is passed
+// on with that ":" removed. The webhook matches values the same way
+type referencePrefix string
+
+// unescape returns the value an escaped value stands for, ok is false when it isn't escaped
+func (p referencePrefix) unescape(value string) (string, bool) {
+	if !strings.HasPrefix(value, string(p)+":") {
+		return value, false
+	}
+	return string(p) + value[len(p)+1:], true
+}
+
+// path returns the parameter path of a value that is an ssm reference
+func (p referencePrefix) path(value string) (string, bool) {
+	if !strings.HasPrefix(value, string(p)) {
+		return "", false
+	}
+	if _, escaped := p.unescape(value); escaped {
+		return "", false
+	}
+	return strings.TrimPrefix(value, string(p)), true
+}
+
 type sanitizedEnviron []string
 
 func (environ *sanitizedEnviron) append(name string, value string) {
@@ -41,11 +101,29 @@ func (environ *sanitizedEnviron) append(name string, value string) {
 
 type secretInjectorFunc func(key, value string)
 
-func injectSecretsFromSsm(references map[string]string, inject secretInjectorFunc, ignoreMissingSecrets bool, logger logrus.FieldLogger) error {
-	secretCache := make(map[string]*ssm.GetParameterOutput)
+// variableOptions are the per variable options of SSM_VARIABLE_OPTIONS, set by the webhook for
+// variables of the secrets annotation
+type variableOptions struct {
+	Optional bool  `json:"optional,omitempty"`
+	FileMode *bool `json:"fileMode,omitempty"`
+}
+
+// secretResolver reads parameters from SSM, each path is read once. With a cache dir, values
+// are shared for the cache TTL with the exec handlers of the container
+type secretResolver struct {
+	ssmsvc               ssmiface.SSMAPI
+	cache                map[string]string
+	cacheDir             string
+	cacheTTL             time.Duration
+	pathPrefix           string
+	allowedPrefixes      [][]string
+	ignoreMissingSecrets bool
+	logger               logrus.FieldLogger
+}
 
+func newSecretResolver(ignoreMissingSecrets bool, logger logrus.FieldLogger) *secretResolver {
 	// Create AWS client service
-	region, present := os.LookupEnv("SSM_AWS_REGION")
+	region, present := os.LookupEnv("SSM_AWS_REGION" + envSuffix)
 	if !present {
 		logger.Fatal("failed to get current AWS region from environment")
 	}
@@ -57,52 +135,350 @@ func injectSecretsFromSsm(references map[string]string, inject secretInjectorFun
 		logger.Fatal("failed to create SSM client", err.Error())
 	}
 
-	ssmsvc := ssm.New(sess, aws.NewConfig().WithRegion(region))
+	resolver := &secretResolver{
+		ssmsvc:               ssm.New(sess, ssmClientConfig(sess, region, getenv("SSM_ROLE_ARN"), logger)),
+		cache:                map[string]string{},
+		pathPrefix:           getenv("SSM_PATH_PREFIX"),
+		ignoreMissingSecrets: ignoreMissingSecrets,
+		logger:               logger,
+	}
+
+	if allowed := getenv("SSM_ALLOWED_PREFIXES"); allowed != "" {
+		if err := json.Unmarshal([]byte(allowed), &resolver.allowedPrefixes); err != nil {
+			logger.Fatalln("invalid SSM_ALLOWED_PREFIXES:", err)
+		}
+	}
+
+	if dir := getenv("SSM_CACHE_DIR"); dir != "" {
+		ttl, err := time.ParseDuration(getenv("SSM_CACHE_TTL"))
+		if err != nil {
+			logger.Fatalln("invalid SSM_CACHE_TTL:", err)
+		}
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			logger.Fatalln("failed to create secret cache directory:", err)
+		}
+		resolver.cacheDir, resolver.cacheTTL = dir, ttl
+	}
+
+	return resolver
+}
+
+func (r *secretResolver) cacheFile(valuePath string) string {
+	return filepath.Join(r.cacheDir, fmt.Sprintf("%x", sha256.Sum256([]byte(valuePath))))
+}
+
+// readCache returns a value cached within the TTL
+func (r *secretResolver) readCache(valuePath string) (string, bool) {
+	if r.cacheDir == "" {
+		return "", false
+	}
+	file := r.cacheFile(valuePath)
+	info, err := os.Stat(file)
+	if err != nil || time.Since(info.ModTime()) > r.cacheTTL {
+		return "", false
+	}
+	value, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", false
+	}
+	return string(value), true
+}
 
+func (r *secretResolver) writeCache(valuePath, value string) {
+	if r.cacheDir == "" {
+		return
+	}
+	if err := writeFileAtomic(r.cacheFile(valuePath), []byte(value), 0600); err != nil {
+		r.logger.Warnln("failed to cache secret from path:", valuePath, err.Error())
+	}
+}
+
+// writeFileAtomic replaces the file, so readers never see it missing or partially written
+func writeFileAtomic(file string, data []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(file), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// resolve returns the value of the parameter, found is false when it can't be read and
+// missing secrets are ignored or the variable is optional
+func (r *secretResolver) resolve(valuePath string, optional bool) (value string, found bool, err error) {
+	ignoreMissingSecrets := r.ignoreMissingSecrets || optional
+
+	// relative paths were resolved against the same prefix by the webhook at admission
+	if r.pathPrefix != "" && !strings.HasPrefix(valuePath, "/") {
+		valuePath = r.pathPrefix + valuePath
+	}
+	valuePath, err = expandPath(valuePath, os.LookupEnv)
+	if err != nil {
+		if !ignoreMissingSecrets {
+			return "", false, err
+		}
+		r.logger.Errorln(err.Error())
+		return "", false, nil
+	}
+	// the webhook checked the references it saw at admission, ConfigMaps and kubelet expansion
+	// can change them afterwards
+	if !r.pathAllowed(valuePath) {
+		return "", false, errors.NewWithDetails("path not allowed by SsmInjectionPolicy:", valuePath)
+	}
+
+	if value, ok := r.cache[valuePath]; ok {
+		return value, true, nil
+	}
+	if value, ok := r.readCache(valuePath); ok {
+		r.cache[valuePath] = value
+		return value, true, nil
+	}
+
+	withDecryption := true
+	secret, err := r.ssmsvc.GetParameter(&ssm.GetParameterInput{
+		Name:           aws.String(valuePath),
+		WithDecryption: aws.Bool(withDecryption),
+	})
+	if err != nil {
+		if !ignoreMissingSecrets {
+			return "", false, errors.WrapWithDetails(err, "failed to read secret from path:", valuePath)
+		}
+		r.logger.Errorln("failed to read secret from path:", valuePath, err.Error())
+		return "", false, nil
+	}
+
+	if secret.Parameter == nil || secret.Parameter.Value == nil {
+		if !ignoreMissingSecrets {
+			return "", false, errors.NewWithDetails("path not found:", valuePath)
+		}
+		r.logger.Errorln("path not found:", valuePath)
+		return "", false, nil
+	}
+
+	r.cache[valuePath] = *secret.Parameter.Value
+	r.writeCache(valuePath, *secret.Parameter.Value)
+	return *secret.Parameter.Value, true, nil
+}
+
+// pathAllowed reports whether the path has one of the allowed prefixes of every policy, as the
+// webhook checks it
+func (r *secretResolver) pathAllowed(valuePath string) bool {
+	for _, prefixes := range r.allowedPrefixes {
+		allowed := false
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(valuePath, prefix) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+	return true
+}
+
+// expandPath replaces the ${VAR} references of a parameter path with the values of the variables,
+// as ssm-env received them. Undefined variables are an error rather than an unexpected path
+func expandPath(valuePath string, lookup func(string) (string, bool)) (string, error) {
+	var err error
+	expanded := pathVariable.ReplaceAllStringFunc(valuePath, func(variable string) string {
+		name := pathVariable.FindStringSubmatch(variable)[1]
+		value, ok := lookup(name)
+		if !ok && err == nil {
+			err = errors.NewWithDetails("undefined variable in path:", valuePath, "variable", name)
+		}
+		return value
+	})
+	return expanded, err
+}
+
+func injectSecretsFromSsm(resolver *secretResolver, prefix referencePrefix, references map[string]string, options map[string]variableOptions, inject, injectSecret secretInjectorFunc) error {
 	for name, value := range references {
-		if !strings.HasPrefix(value, "ssm:") {
+		if unescaped, escaped := prefix.unescape(value); escaped {
+			inject(name, unescaped)
+			continue
+		}
+		valuePath, ok := prefix.path(value)
+		if !ok {
 			inject(name, value)
 			continue
 		}
 
-		valuePath := strings.TrimPrefix(value, "ssm:")
+		secret, found, err := resolver.resolve(valuePath, options[name].Optional)
+		if err != nil {
+			return err
+		}
+		if !found {
+			continue
+		}
+
+		injectSecret(name, secret)
+	}
+
+	return nil
+}
+
+// splitArg splits an argument that is an ssm reference or escaped value as a whole, or a
+// flag=ssm:path argument, into the part kept as it is and the value. The webhook matches
+// arguments the same way
+func (p referencePrefix) splitArg(arg string) (kept, value string, ok bool) {
+	if strings.HasPrefix(arg, string(p)) {
+		return "", arg, true
+	}
+	if i := strings.Index(arg, "="+string(p)); i >= 0 {
+		return arg[:i+1], arg[i+1:], true
+	}
+	return "", "", false
+}
+
+// resolveArgs substitutes the values of ssm references in the arguments and unescapes escaped
+// values. An argument whose parameter can't be read while missing secrets are ignored is
+// passed as it is. Templated arguments are left to expandArgs: the kubelet expanded them to
+// the references of their variables, which may be embedded anywhere in the argument
+func resolveArgs(resolver *secretResolver, prefix referencePrefix, args []string, templates argTemplates) ([]string, error) {
+	resolved := make([]string, len(args))
+	for i, arg := range args {
+		resolved[i] = arg
+		if _, ok := templates.Args[i]; ok {
+			continue
+		}
+
+		kept, value, ok := prefix.splitArg(arg)
+		if !ok {
+			continue
+		}
+		if unescaped, escaped := prefix.unescape(value); escaped {
+			resolved[i] = kept + unescaped
+			continue
+		}
+		valuePath, _ := prefix.path(value)
+		secret, found, err := resolver.resolve(valuePath, false)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			resolved[i] = kept + secret
+		}
+	}
+	return resolved, nil
+}
+
+// argTemplates is the SSM_EXPAND_ARGS manifest set by the webhook: the argument templates by
+// index, and the variables of the container spec the kubelet expanded them with
+type argTemplates struct {
+	Args      map[int]string `json:"args"`
+	Variables []string       `json:"variables"`
+}
+
+// parseArgTemplates parses the SSM_EXPAND_ARGS manifest
+func parseArgTemplates(manifest string, args int) (argTemplates, error) {
+	var templates argTemplates
+	if err := json.Unmarshal([]byte(manifest), &templates); err != nil {
+		return argTemplates{}, errors.WrapIf(err, "invalid SSM_EXPAND_ARGS")
+	}
+	for i := range templates.Args {
+		if i < 0 || i >= args {
+			return argTemplates{}, errors.NewWithDetails("SSM_EXPAND_ARGS references a missing argument:", i)
+		}
+	}
+	return templates, nil
+}
+
+// expandArgs expands the argument templates again, now the variables hold the secrets. The
+// kubelet expanded them to the ssm references. Only the variables of the container spec are
+// expanded, as the kubelet did, not those ssm-env runs with otherwise
+func expandArgs(args []string, templates argTemplates, environ sanitizedEnviron) []string {
+	variables := make(map[string]bool, len(templates.Variables))
+	for _, name := range templates.Variables {
+		variables[name] = true
+	}
+	values := map[string]string{}
+	for _, env := range environ {
+		split := strings.SplitN(env, "=", 2)
+		if variables[split[0]] {
+			values[split[0]] = split[1]
+		}
+	}
+	mapping := func(name string) (string, bool) {
+		value, ok := values[name]
+		return value, ok
+	}
+
+	expanded := append([]string(nil), args...)
+	for i, template := range templates.Args {
+		expanded[i] = expand(template, mapping)
+	}
+	return expanded
+}
 
-		var secret *ssm.GetParameterOutput
-		var err error
+// expand follows the kubelet: $(VAR) is replaced by the value of VAR when it is defined,
+// $$ is an escaped $ and anything else is kept as it is
+func expand(input string, mapping func(string) (string, bool)) string {
+	var buf strings.Builder
+	checkpoint := 0
+	for cursor := 0; cursor < len(input); cursor++ {
+		if input[cursor] == '$' && cursor+1 < len(input) {
+			buf.WriteString(input[checkpoint:cursor])
 
-		if secret = secretCache[valuePath]; secret == nil {
-			withDecryption := true
-			secret, err = ssmsvc.GetParameter(&ssm.GetParameterInput{
-				Name:           aws.String(valuePath),
-				WithDecryption: aws.Bool(withDecryption),
-			})
-			if err != nil {
-				if !ignoreMissingSecrets {
-					return errors.WrapWithDetails(err, "failed to read secret from path:", valuePath)
+			read, isVar, advance := tryReadVariableName(input[cursor+1:])
+			if isVar {
+				if value, ok := mapping(read); ok {
+					buf.WriteString(value)
+				} else {
+					buf.WriteString("$(" + read + ")")
 				}
-				logger.Errorln("failed to read secret from path:", valuePath, err.Error())
 			} else {
-				secretCache[valuePath] = secret
+				buf.WriteString(read)
 			}
+
+			cursor += advance
+			checkpoint = cursor + 1
 		}
+	}
+	return buf.String() + input[checkpoint:]
+}
 
-		if secret == nil {
-			if !ignoreMissingSecrets {
-				return errors.NewWithDetails("path not found:", valuePath)
+func tryReadVariableName(input string) (string, bool, int) {
+	switch input[0] {
+	case '$':
+		return "$", false, 1
+	case '(':
+		for i := 1; i < len(input); i++ {
+			if input[i] == ')' {
+				return input[1:i], true, i + 1
 			}
-
-			logger.Errorln("path not found:", valuePath)
-			continue
 		}
-
-		inject(name, *secret.Parameter.Value)
+		// incomplete reference, kept as it is
+		return "$(", false, 1
+	default:
+		return "$" + string(input[0]), false, 1
 	}
+}
 
-	return nil
+// parseArgs returns the command ssm-env runs, exec probes and lifecycle hooks are wrapped by the
+// webhook with a leading --exec-handler
+func parseArgs(args []string) (command []string, execHandler bool) {
+	if len(args) > 0 && args[0] == execHandlerArg {
+		return args[1:], true
+	}
+	return args, false
 }
 
 func main() {
-	enableJSONLog := cast.ToBool(os.Getenv("SSM_JSON_LOG"))
+	envSuffix = ssmEnvSuffix(os.Args[0])
+	enableJSONLog := cast.ToBool(getenv("SSM_JSON_LOG"))
 
 	var logger logrus.FieldLogger
 	{
@@ -113,11 +489,9 @@ func main() {
 		logger = log.WithField("app", "ssm-env")
 	}
 
-	var entrypointCmd []string
-	if len(os.Args) == 1 {
+	entrypointCmd, execHandler := parseArgs(os.Args[1:])
+	if len(entrypointCmd) == 0 {
 		logger.Fatalln("no command is given, ssm-env can't determine the entrypoint (command), please specify it explicitly or let the webhook query it (see documentation)")
-	} else {
-		entrypointCmd = os.Args[1:]
 	}
 
 	binary, err := exec.LookPath(entrypointCmd[0])
@@ -126,7 +500,7 @@ func main() {
 	}
 
 	// Used both for reading secrets and transit encryption
-	ignoreMissingSecrets := cast.ToBool(os.Getenv("SSM_IGNORE_MISSING_SECRETS"))
+	ignoreMissingSecrets := cast.ToBool(getenv("SSM_IGNORE_MISSING_SECRETS"))
 
 	// initial and sanitized environs
 	environ := make(map[string]string, len(os.Environ()))
@@ -143,15 +517,63 @@ func main() {
 		sanitized.append(key, value)
 	}
 
-	err = injectSecretsFromSsm(environ, inject, ignoreMissingSecrets, logger)
+	options := map[string]variableOptions{}
+	if manifest := getenv("SSM_VARIABLE_OPTIONS"); manifest != "" {
+		if err := json.Unmarshal([]byte(manifest), &options); err != nil {
+			logger.Fatalln("invalid SSM_VARIABLE_OPTIONS:", err)
+		}
+	}
+
+	// SSM_FILE_MODE=false limits file mode to the variables with the fileMode option
+	injectSecret := inject
+	if dir := getenv("SSM_FILE_DIR"); dir != "" {
+		injectSecret, err = fileInjector(dir, getenv("SSM_FILE_MODE") != "false", options, inject, logger)
+		if err != nil {
+			logger.Fatalln(err)
+		}
+	}
+
+	prefix := referencePrefix("ssm:")
+	if value := getenv("SSM_REFERENCE_PREFIX"); value != "" {
+		prefix = referencePrefix(value)
+	}
+	// the prefix would be taken for a reference itself
+	delete(environ, "SSM_REFERENCE_PREFIX"+envSuffix)
+
+	resolver := newSecretResolver(ignoreMissingSecrets, logger)
+
+	err = injectSecretsFromSsm(resolver, prefix, environ, options, inject, injectSecret)
 	if err != nil {
 		logger.Fatalln("failed to inject secrets from ssm:", err)
 	}
 
-	logger.Infoln("spawning process:", entrypointCmd)
+	// the kubelet doesn't expand exec handler commands, and the manifest is for the container process
+	var templates argTemplates
+	if manifest := getenv("SSM_EXPAND_ARGS"); manifest != "" && !execHandler {
+		templates, err = parseArgTemplates(manifest, len(entrypointCmd))
+		if err != nil {
+			logger.Fatalln("failed to expand arguments:", err)
+		}
+	}
+
+	if err := spawn(logger, resolver, prefix, binary, entrypointCmd, templates, sanitized); err != nil {
+		logger.Fatalln(err)
+	}
+}
 
-	err = syscall.Exec(binary, entrypointCmd, sanitized)
+// spawn runs the command with the references of its arguments resolved. The arguments are
+// logged with their references rather than the values
+func spawn(logger logrus.FieldLogger, resolver *secretResolver, prefix referencePrefix, binary string, command []string, templates argTemplates, environ sanitizedEnviron) error {
+	args, err := resolveArgs(resolver, prefix, command, templates)
 	if err != nil {
-		logger.Fatalln("failed to exec process", entrypointCmd, err.Error())
+		return errors.WrapIf(err, "failed to resolve arguments from ssm")
 	}
+	args = expandArgs(args, templates, environ)
+
+	logger.Infoln("spawning process:", command)
+
+	if err := execProcess(binary, args, environ); err != nil {
+		return errors.WrapIfWithDetails(err, "failed to exec process", "command", command)
+	}
+	return nil
 }
@@ -0,0 +1,571 @@
+// Copyright © 2020 Peter Wilson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+	cmp "github.com/google/go-cmp/cmp"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+// fakeSSM serves the parameters it holds and counts the calls
+type fakeSSM struct {
+	ssmiface.SSMAPI
+	parameters map[string]string
+	calls      int
+}
+
+func (f *fakeSSM) GetParameter(input *ssm.GetParameterInput) (*ssm.GetParameterOutput, error) {
+	f.calls++
+	value, ok := f.parameters[aws.StringValue(input.Name)]
+	if !ok {
+		return nil, awserr.New(ssm.ErrCodeParameterNotFound, "parameter not found", nil)
+	}
+	return &ssm.GetParameterOutput{Parameter: &ssm.Parameter{Name: input.Name, Value: aws.String(value)}}, nil
+}
+
+func newTestResolver(parameters map[string]string) *secretResolver {
+	logger, _ := test.NewNullLogger()
+	return &secretResolver{
+		ssmsvc: &fakeSSM{parameters: parameters},
+		cache:  map[string]string{},
+		logger: logger,
+	}
+}
+
+func Test_referencePrefix_splitArg(t *testing.T) {
+	tests := []struct {
+		name      string
+		arg       string
+		wantKept  string
+		wantValue string
+		wantOk    bool
+	}{
+		{name: "reference", arg: "ssm:/db/pass", wantValue: "ssm:/db/pass", wantOk: true},
+		{name: "flag", arg: "--token=ssm:/api/token", wantKept: "--token=", wantValue: "ssm:/api/token", wantOk: true},
+		{name: "escaped flag", arg: "--note=ssm::literal", wantKept: "--note=", wantValue: "ssm::literal", wantOk: true},
+		{name: "plain", arg: "--verbose"},
+		{name: "embedded", arg: "url=https://ssm:443"},
+		{name: "prefix inside", arg: "x-ssm:/db/pass"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kept, value, ok := referencePrefix("ssm:").splitArg(tt.arg)
+			if kept != tt.wantKept || value != tt.wantValue || ok != tt.wantOk {
+				t.Errorf("referencePrefix.splitArg() = %q, %q, %v, want %q, %q, %v", kept, value, ok, tt.wantKept, tt.wantValue, tt.wantOk)
+			}
+		})
+	}
+}
+
+func Test_resolveArgs(t *testing.T) {
+	parameters := map[string]string{"/db/pass": "s3cr3t", "/api/token": "t0k3n"}
+
+	tests := []struct {
+		name                 string
+		args                 []string
+		templates            argTemplates
+		ignoreMissingSecrets bool
+		want                 []string
+		wantErr              bool
+	}{
+		{
+			name: "references and escaped values",
+			args: []string{"/app", "ssm:/db/pass", "--token=ssm:/api/token", "ssm::literal", "--note=ssm::x", "--verbose"},
+			want: []string{"/app", "s3cr3t", "--token=t0k3n", "ssm:literal", "--note=ssm:x", "--verbose"},
+		},
+		{
+			name:      "templated arguments are left to expandArgs",
+			args:      []string{"/app", "--dsn=ssm:/db/pass@host"},
+			templates: argTemplates{Args: map[int]string{1: "--dsn=$(DB_PASS)@host"}, Variables: []string{"DB_PASS"}},
+			want:      []string{"/app", "--dsn=ssm:/db/pass@host"},
+		},
+		{
+			name:    "missing parameter",
+			args:    []string{"/app", "ssm:/missing"},
+			wantErr: true,
+		},
+		{
+			name:                 "missing parameter ignored",
+			args:                 []string{"/app", "ssm:/missing"},
+			ignoreMissingSecrets: true,
+			want:                 []string{"/app", "ssm:/missing"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resolver := newTestResolver(parameters)
+			resolver.ignoreMissingSecrets = tt.ignoreMissingSecrets
+
+			got, err := resolveArgs(resolver, "ssm:", tt.args, tt.templates)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("resolveArgs() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !cmp.Equal(got, tt.want) {
+				t.Errorf("resolveArgs() diff %v", cmp.Diff(got, tt.want))
+			}
+		})
+	}
+}
+
+func Test_spawn(t *testing.T) {
+	var gotArgs []string
+	defer func(original func(string, []string, []string) error) { execProcess = original }(execProcess)
+	execProcess = func(binary string, args []string, environ []string) error {
+		gotArgs = args
+		return nil
+	}
+	logger, hook := test.NewNullLogger()
+	resolver := newTestResolver(map[string]string{"/api/token": "t0k3n"})
+	command := []string{"/app", "--token=ssm:/api/token"}
+
+	if err := spawn(logger, resolver, "ssm:", "/app", command, argTemplates{}, nil); err != nil {
+		t.Fatalf("spawn() error = %v", err)
+	}
+
+	if want := []string{"/app", "--token=t0k3n"}; !cmp.Equal(gotArgs, want) {
+		t.Errorf("spawn() args diff %v", cmp.Diff(gotArgs, want))
+	}
+	// the process gets the values, the log line only the references
+	message := hook.LastEntry().Message
+	if !strings.Contains(message, "--token=ssm:/api/token") || strings.Contains(message, "t0k3n") {
+		t.Errorf("spawn() logged %q, want the references only", message)
+	}
+	if !cmp.Equal(command, []string{"/app", "--token=ssm:/api/token"}) {
+		t.Errorf("spawn() changed the command to %v", command)
+	}
+}
+
+func Test_expand(t *testing.T) {
+	mapping := func(name string) (string, bool) {
+		value, ok := map[string]string{"DB_PASS": "s3cr3t", "EMPTY": ""}[name]
+		return value, ok
+	}
+
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{name: "variable", input: "--dsn=$(DB_PASS)@host", want: "--dsn=s3cr3t@host"},
+		{name: "empty variable", input: "x$(EMPTY)y", want: "xy"},
+		{name: "undefined variable", input: "$(OTHER)", want: "$(OTHER)"},
+		{name: "escaped", input: "$$(DB_PASS)", want: "$(DB_PASS)"},
+		{name: "incomplete", input: "$(DB_PASS", want: "$(DB_PASS"},
+		{name: "other character", input: "$DB_PASS", want: "$DB_PASS"},
+		{name: "trailing dollar", input: "cost$", want: "cost$"},
+		{name: "no variables", input: "plain", want: "plain"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := expand(tt.input, mapping); got != tt.want {
+				t.Errorf("expand() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_tryReadVariableName(t *testing.T) {
+	tests := []struct {
+		input       string
+		wantRead    string
+		wantIsVar   bool
+		wantAdvance int
+	}{
+		{input: "(DB_PASS)@host", wantRead: "DB_PASS", wantIsVar: true, wantAdvance: 9},
+		{input: "$(DB_PASS)", wantRead: "$", wantAdvance: 1},
+		{input: "(DB_PASS", wantRead: "$(", wantAdvance: 1},
+		{input: "x", wantRead: "$x", wantAdvance: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			read, isVar, advance := tryReadVariableName(tt.input)
+			if read != tt.wantRead || isVar != tt.wantIsVar || advance != tt.wantAdvance {
+				t.Errorf("tryReadVariableName() = %q, %v, %d, want %q, %v, %d", read, isVar, advance, tt.wantRead, tt.wantIsVar, tt.wantAdvance)
+			}
+		})
+	}
+}
+
+func Test_parseArgTemplates(t *testing.T) {
+	tests := []struct {
+		name     string
+		manifest string
+		want     argTemplates
+		wantErr  bool
+	}{
+		{
+			name:     "templates",
+			manifest: `{"args":{"1":"--dsn=$(DB_PASS)@host"},"variables":["DB_PASS"]}`,
+			want:     argTemplates{Args: map[int]string{1: "--dsn=$(DB_PASS)@host"}, Variables: []string{"DB_PASS"}},
+		},
+		{name: "out of range", manifest: `{"args":{"2":"$(DB_PASS)"}}`, wantErr: true},
+		{name: "negative", manifest: `{"args":{"-1":"$(DB_PASS)"}}`, wantErr: true},
+		{name: "invalid", manifest: `["$(DB_PASS)"]`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseArgTemplates(tt.manifest, 2)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseArgTemplates() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !cmp.Equal(got, tt.want) {
+				t.Errorf("parseArgTemplates() diff %v", cmp.Diff(got, tt.want))
+			}
+		})
+	}
+}
+
+func Test_expandArgs(t *testing.T) {
+	environ := sanitizedEnviron{"DB_PASS=s3cr3t", "DSN=a=b", "SSM_AWS_REGION=eu-west-1"}
+
+	tests := []struct {
+		name      string
+		args      []string
+		templates argTemplates
+		want      []string
+	}{
+		{
+			name: "templates",
+			args: []string{"/app", "--dsn=ssm:/db/pass@host", "$(DSN)", "--verbose"},
+			templates: argTemplates{
+				Args:      map[int]string{1: "--dsn=$(DB_PASS)@host", 2: "$(DSN)"},
+				Variables: []string{"DB_PASS", "DSN"},
+			},
+			want: []string{"/app", "--dsn=s3cr3t@host", "a=b", "--verbose"},
+		},
+		{
+			name: "escaped and undefined variables",
+			args: []string{"/app", "$(DB_PASS)", "$(OTHER)"},
+			templates: argTemplates{
+				Args:      map[int]string{1: "$$(DB_PASS)", 2: "$(OTHER)"},
+				Variables: []string{"DB_PASS"},
+			},
+			want: []string{"/app", "$(DB_PASS)", "$(OTHER)"},
+		},
+		{
+			name: "variables outside the container spec",
+			args: []string{"/app", "ssm:/db/pass eu-west-1"},
+			templates: argTemplates{
+				Args:      map[int]string{1: "$(DB_PASS) $(SSM_AWS_REGION)"},
+				Variables: []string{"DB_PASS"},
+			},
+			want: []string{"/app", "s3cr3t $(SSM_AWS_REGION)"},
+		},
+		{
+			name: "no templates",
+			args: []string{"/app", "$(DB_PASS)"},
+			want: []string{"/app", "$(DB_PASS)"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := append([]string(nil), tt.args...)
+			if got := expandArgs(args, tt.templates, environ); !cmp.Equal(got, tt.want) {
+				t.Errorf("expandArgs() diff %v", cmp.Diff(got, tt.want))
+			}
+			if !cmp.Equal(args, tt.args) {
+				t.Errorf("expandArgs() changed its arguments to %v", args)
+			}
+		})
+	}
+}
+
+func Test_parseArgs(t *testing.T) {
+	tests := []struct {
+		name            string
+		args            []string
+		wantCommand     []string
+		wantExecHandler bool
+	}{
+		{name: "process", args: []string{"/app", "--verbose"}, wantCommand: []string{"/app", "--verbose"}},
+		{name: "exec handler", args: []string{"--exec-handler", "/check", "--live"}, wantCommand: []string{"/check", "--live"}, wantExecHandler: true},
+		{name: "exec handler without command", args: []string{"--exec-handler"}, wantCommand: []string{}, wantExecHandler: true},
+		{name: "flag of the process", args: []string{"/app", "--exec-handler"}, wantCommand: []string{"/app", "--exec-handler"}},
+		{name: "no command", args: []string{}, wantCommand: []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			command, execHandler := parseArgs(tt.args)
+			if !cmp.Equal(command, tt.wantCommand) || execHandler != tt.wantExecHandler {
+				t.Errorf("parseArgs() = %v, %v, want %v, %v", command, execHandler, tt.wantCommand, tt.wantExecHandler)
+			}
+		})
+	}
+}
+
+func Test_secretResolver_cache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssm-env-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	newCachingResolver := func(parameters map[string]string) (*secretResolver, *fakeSSM) {
+		resolver := newTestResolver(parameters)
+		resolver.cacheDir, resolver.cacheTTL = dir, time.Minute
+		return resolver, resolver.ssmsvc.(*fakeSSM)
+	}
+
+	// the container process reads the parameter and caches it
+	process, processSSM := newCachingResolver(map[string]string{"/db/pass": "s3cr3t"})
+	if value, found, err := process.resolve("/db/pass", false); err != nil || !found || value != "s3cr3t" {
+		t.Fatalf("secretResolver.resolve() = %v, %v, %v, want s3cr3t", value, found, err)
+	}
+	if processSSM.calls != 1 {
+		t.Errorf("secretResolver.resolve() called ssm %d times, want 1", processSSM.calls)
+	}
+	info, err := os.Stat(process.cacheFile("/db/pass"))
+	if err != nil {
+		t.Fatalf("secretResolver.resolve() didn't cache the value: %v", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("secretResolver.resolve() cached the value with mode %v, want 0600", info.Mode().Perm())
+	}
+
+	// an exec handler reads it from the cache within the TTL
+	handler, handlerSSM := newCachingResolver(nil)
+	if value, found, err := handler.resolve("/db/pass", false); err != nil || !found || value != "s3cr3t" {
+		t.Fatalf("secretResolver.resolve() = %v, %v, %v, want s3cr3t from the cache", value, found, err)
+	}
+	if handlerSSM.calls != 0 {
+		t.Errorf("secretResolver.resolve() called ssm %d times, want the cache", handlerSSM.calls)
+	}
+
+	// and from ssm once it expired
+	expired := time.Now().Add(-2 * time.Minute)
+	if err := os.Chtimes(process.cacheFile("/db/pass"), expired, expired); err != nil {
+		t.Fatal(err)
+	}
+	handler, handlerSSM = newCachingResolver(map[string]string{"/db/pass": "r0tat3d"})
+	if value, found, err := handler.resolve("/db/pass", false); err != nil || !found || value != "r0tat3d" {
+		t.Fatalf("secretResolver.resolve() = %v, %v, %v, want r0tat3d from ssm", value, found, err)
+	}
+	if handlerSSM.calls != 1 {
+		t.Errorf("secretResolver.resolve() called ssm %d times, want 1", handlerSSM.calls)
+	}
+	if value, ok := handler.readCache("/db/pass"); !ok || value != "r0tat3d" {
+		t.Errorf("secretResolver.readCache() = %v, %v, want the refreshed value", value, ok)
+	}
+}
+
+func Test_secretResolver_readCache_disabled(t *testing.T) {
+	resolver := newTestResolver(nil)
+	resolver.writeCache("/db/pass", "s3cr3t")
+	if value, ok := resolver.readCache("/db/pass"); ok {
+		t.Errorf("secretResolver.readCache() = %v, want no cache without a cache dir", value)
+	}
+}
+
+func Test_writeFileAtomic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssm-env-files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "DB_PASS")
+
+	// the file is rewritten by exec handlers and when the container restarts, read-only as it is
+	for _, value := range []string{"s3cr3t", "r0tat3d"} {
+		if err := writeFileAtomic(file, []byte(value), 0400); err != nil {
+			t.Fatalf("writeFileAtomic() error = %v", err)
+		}
+		data, err := ioutil.ReadFile(file)
+		if err != nil || string(data) != value {
+			t.Fatalf("writeFileAtomic() wrote %q, %v, want %q", data, err, value)
+		}
+	}
+
+	info, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0400 {
+		t.Errorf("writeFileAtomic() mode = %v, want 0400", info.Mode().Perm())
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Errorf("writeFileAtomic() left %d files, want the file only", len(files))
+	}
+}
+
+func Test_expandPath(t *testing.T) {
+	lookup := func(name string) (string, bool) {
+		value, ok := map[string]string{"ENVIRONMENT": "prod", "POD_NAMESPACE": "team-a", "EMPTY": ""}[name]
+		return value, ok
+	}
+
+	tests := []struct {
+		name    string
+		path    string
+		want    string
+		wantErr bool
+	}{
+		{name: "variables", path: "/app/${ENVIRONMENT}/${POD_NAMESPACE}/db", want: "/app/prod/team-a/db"},
+		{name: "empty variable", path: "/app/${EMPTY}db", want: "/app/db"},
+		{name: "no variables", path: "/app/db", want: "/app/db"},
+		{name: "kubelet syntax", path: "/app/$(ENVIRONMENT)/db", want: "/app/$(ENVIRONMENT)/db"},
+		{name: "undefined variable", path: "/app/${OTHER}/db", wantErr: true},
+		{name: "empty name", path: "/app/${}/db", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := expandPath(tt.path, lookup)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expandPath() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("expandPath() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_secretResolver_resolve_pathPrefix(t *testing.T) {
+	os.Setenv("SSM_ENV_TEST_ENVIRONMENT", "staging")
+	os.Setenv("SSM_ENV_TEST_ABSOLUTE", "/shared")
+	defer os.Unsetenv("SSM_ENV_TEST_ENVIRONMENT")
+	defer os.Unsetenv("SSM_ENV_TEST_ABSOLUTE")
+	parameters := map[string]string{
+		"/prod/team-a/api/db/staging/pass":  "relative",
+		"/shared/pass":                      "absolute",
+		"/prod/team-a/api//shared/pass":     "prefixed",
+		"/prod/team-a/api/${UNDEFINED}/pas": "unexpanded",
+	}
+
+	tests := []struct {
+		name                 string
+		path                 string
+		ignoreMissingSecrets bool
+		want                 string
+		wantFound            bool
+		wantErr              bool
+	}{
+		{name: "relative path", path: "db/${SSM_ENV_TEST_ENVIRONMENT}/pass", want: "relative", wantFound: true},
+		{name: "absolute path", path: "/shared/pass", want: "absolute", wantFound: true},
+		// the prefix is added to the path as written, a variable doesn't make it absolute
+		{name: "variable holding an absolute path", path: "${SSM_ENV_TEST_ABSOLUTE}/pass", want: "prefixed", wantFound: true},
+		{name: "undefined variable", path: "${UNDEFINED}/pas", wantErr: true},
+		{name: "undefined variable ignored", path: "${UNDEFINED}/pas", ignoreMissingSecrets: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resolver := newTestResolver(parameters)
+			resolver.pathPrefix = "/prod/team-a/api/"
+			resolver.ignoreMissingSecrets = tt.ignoreMissingSecrets
+
+			got, found, err := resolver.resolve(tt.path, false)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("secretResolver.resolve() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want || found != tt.wantFound {
+				t.Errorf("secretResolver.resolve() = %v, %v, want %v, %v", got, found, tt.want, tt.wantFound)
+			}
+		})
+	}
+}
+
+func Test_referencePrefix_unescape(t *testing.T) {
+	tests := []struct {
+		prefix      referencePrefix
+		value       string
+		want        string
+		wantEscaped bool
+	}{
+		{prefix: "ssm:", value: "ssm::literal", want: "ssm:literal", wantEscaped: true},
+		{prefix: "ssm:", value: "ssm:::colons", want: "ssm::colons", wantEscaped: true},
+		{prefix: "ssm:", value: "ssm:/db/pass", want: "ssm:/db/pass"},
+		{prefix: "ssm:", value: "plain", want: "plain"},
+		{prefix: "ssm-eu:", value: "ssm-eu::literal", want: "ssm-eu:literal", wantEscaped: true},
+		{prefix: "ssm-eu:", value: "ssm::literal", want: "ssm::literal"},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.prefix)+tt.value, func(t *testing.T) {
+			got, escaped := tt.prefix.unescape(tt.value)
+			if got != tt.want || escaped != tt.wantEscaped {
+				t.Errorf("referencePrefix.unescape() = %v, %v, want %v, %v", got, escaped, tt.want, tt.wantEscaped)
+			}
+		})
+	}
+}
+
+func Test_referencePrefix_path(t *testing.T) {
+	tests := []struct {
+		prefix referencePrefix
+		value  string
+		want   string
+		wantOk bool
+	}{
+		{prefix: "ssm:", value: "ssm:/db/pass", want: "/db/pass", wantOk: true},
+		{prefix: "ssm:", value: "ssm:db/pass", want: "db/pass", wantOk: true},
+		{prefix: "ssm:", value: "ssm::literal"},
+		{prefix: "ssm:", value: "plain"},
+		{prefix: "ssm:", value: "ssm-eu:/db/pass"},
+		{prefix: "ssm-eu:", value: "ssm-eu:/db/pass", want: "/db/pass", wantOk: true},
+		{prefix: "ssm-eu:", value: "ssm:/db/pass"},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.prefix)+tt.value, func(t *testing.T) {
+			got, ok := tt.prefix.path(tt.value)
+			if got != tt.want || ok != tt.wantOk {
+				t.Errorf("referencePrefix.path() = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
+
+func Test_ssmEnvSuffix(t *testing.T) {
+	tests := []struct {
+		executable string
+		want       string
+	}{
+		{executable: "/mutate/ssm-env", want: ""},
+		{executable: "/mutate-ssm-eu/ssm-env", want: "_SSM_EU"},
+		{executable: "/mutate-vault/ssm-env", want: "_VAULT"},
+		{executable: "ssm-env", want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.executable, func(t *testing.T) {
+			if got := ssmEnvSuffix(tt.executable); got != tt.want {
+				t.Errorf("ssmEnvSuffix() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
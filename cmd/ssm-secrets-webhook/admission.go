@@ -0,0 +1,190 @@
+// Copyright © 2020 Peter Wilson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+type admissionRecordKey struct{}
+
+// ssmReference is an environment variable backed by an SSM parameter, it never holds the value
+type ssmReference struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+}
+
+type containerRecord struct {
+	Name       string         `json:"name"`
+	References []ssmReference `json:"references"`
+}
+
+// admissionRecord collects what happened to a pod during a single admission
+type admissionRecord struct {
+	mu         sync.Mutex
+	containers []containerRecord
+	warnings   []string
+	skipReason string
+	degraded   map[string]failureMode
+	event      *auditEvent
+	duration   time.Duration
+}
+
+func withAdmissionRecord(ctx context.Context, record *admissionRecord) context.Context {
+	return context.WithValue(ctx, admissionRecordKey{}, record)
+}
+
+// admissionRecordFrom returns the record of the admission, nil when there is none
+func admissionRecordFrom(ctx context.Context) *admissionRecord {
+	record, _ := ctx.Value(admissionRecordKey{}).(*admissionRecord)
+	return record
+}
+
+func (r *admissionRecord) addContainer(name string, envVars []ssmReference) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.containers = append(r.containers, containerRecord{Name: name, References: envVars})
+}
+
+func (r *admissionRecord) mutatedContainers() []containerRecord {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]containerRecord(nil), r.containers...)
+}
+
+// discardContainers forgets the containers recorded by an injection that was abandoned
+func (r *admissionRecord) discardContainers() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.containers = nil
+}
+
+// warn records a problem the pod author should know about, it doesn't fail the admission
+func (r *admissionRecord) warn(format string, args ...interface{}) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.warnings = append(r.warnings, fmt.Sprintf(format, args...))
+}
+
+func (r *admissionRecord) collectedWarnings() []string {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.warnings...)
+}
+
+// skip records why the pod was deliberately left unmutated
+func (r *admissionRecord) skip(reason string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.skipReason = reason
+}
+
+func (r *admissionRecord) skipped() string {
+	if r == nil {
+		return ""
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.skipReason
+}
+
+// degrade records that a lookup of the source failed and the pod was admitted by its failure mode
+func (r *admissionRecord) degrade(source string, mode failureMode) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.degraded == nil {
+		r.degraded = map[string]failureMode{}
+	}
+	r.degraded[source] = mode
+}
+
+// degradations returns the failure modes applied by lookup source
+func (r *admissionRecord) degradations() map[string]failureMode {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	degraded := make(map[string]failureMode, len(r.degraded))
+	for source, mode := range r.degraded {
+		degraded[source] = mode
+	}
+	return degraded
+}
+
+// decide records the outcome of the admission and how long the mutation took
+func (r *admissionRecord) decide(event auditEvent, duration time.Duration) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.event = &event
+	r.duration = duration
+}
+
+// decision returns the outcome of the admission, nil when the pod wasn't reviewed
+func (r *admissionRecord) decision() (*auditEvent, time.Duration) {
+	if r == nil {
+		return nil, 0
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.event, r.duration
+}
+
+func newSsmReference(prefix referencePrefix, name, value string) ssmReference {
+	return ssmReference{Name: name, Path: prefix.path(value)}
+}
+
+// malformedReference returns why the path of an ssm reference looks wrong, empty when it looks fine
+func malformedReference(path string) string {
+	switch {
+	case path == "":
+		return "the parameter path is empty"
+	case strings.TrimSpace(path) != path || strings.ContainsAny(path, " \t\n"):
+		return "the parameter path contains whitespace"
+	case strings.Contains(path, "//"):
+		return "the parameter path contains an empty segment"
+	case strings.HasSuffix(path, "/"):
+		return "the parameter path ends with /"
+	}
+	return ""
+}
@@ -0,0 +1,179 @@
+// Copyright © 2020 Peter Wilson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	annotationPrefix = "ssm.pwillie.github.io/"
+
+	// entrypointsAnnotation holds a JSON object of container name to entrypoint and cmd,
+	// e.g. {"app": {"entrypoint": ["/app"], "cmd": ["serve"]}}
+	entrypointsAnnotation = annotationPrefix + "entrypoints"
+
+	// injectAnnotation set to "false" opts the pod out of injection
+	injectAnnotation = annotationPrefix + "inject"
+
+	// secretsAnnotation holds a YAML or JSON object of variable name to parameter, it is read
+	// per reference prefix
+	secretsAnnotation = annotationPrefix + "secrets"
+
+	// settings overridable by namespace and pod annotations
+	awsRegionAnnotation            = annotationPrefix + "aws-region"
+	ssmEnvImageAnnotation          = annotationPrefix + "ssm-env-image"
+	ignoreMissingSecretsAnnotation = annotationPrefix + "ignore-missing-secrets"
+	roleARNAnnotation              = annotationPrefix + "role-arn"
+	fileModeAnnotation             = annotationPrefix + "file-mode"
+	wrapExecHandlersAnnotation     = annotationPrefix + "wrap-exec-handlers"
+
+	// only read from namespaces
+	configMapFailureModeAnnotation = annotationPrefix + "configmap-failure-mode"
+	secretFailureModeAnnotation    = annotationPrefix + "secret-failure-mode"
+	registryFailureModeAnnotation  = annotationPrefix + "registry-failure-mode"
+
+	// set by the webhook on mutated pods, the annotations per reference prefix
+	injectedLabel                 = annotationPrefix + "injected"
+	injectedEnvAnnotation         = annotationPrefix + "injected-env"
+	injectedSsmEnvImageAnnotation = annotationPrefix + "injected-ssm-env-image"
+	webhookVersionAnnotation      = annotationPrefix + "webhook-version"
+	mutatedAtAnnotation           = annotationPrefix + "mutated-at"
+)
+
+// ssmConfig holds the per pod configuration parsed from the pod annotations
+type ssmConfig struct {
+	Entrypoints map[string]imageEntrypoint
+	Secrets     map[string]secretManifestEntry
+}
+
+// injectionEnabled reads the inject annotation, it opts the pod out of every webhook
+func injectionEnabled(pod *corev1.Pod) (bool, error) {
+	val, ok := pod.GetAnnotations()[injectAnnotation]
+	if !ok {
+		return true, nil
+	}
+	inject, err := strconv.ParseBool(val)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s annotation, expected true or false: %s", injectAnnotation, err)
+	}
+	return inject, nil
+}
+
+// parseSsmConfig reads the entrypoints annotation, shared by the webhooks as entrypoints belong
+// to the images, and the secrets annotation of the reference prefix
+func parseSsmConfig(pod *corev1.Pod, prefix referencePrefix) (ssmConfig, error) {
+	config := ssmConfig{}
+	annotations := pod.GetAnnotations()
+
+	if val, ok := annotations[entrypointsAnnotation]; ok {
+		if err := json.Unmarshal([]byte(val), &config.Entrypoints); err != nil {
+			return config, fmt.Errorf("invalid %s annotation, expected a JSON object of container name to {\"entrypoint\": [...], \"cmd\": [...]}: %s", entrypointsAnnotation, err)
+		}
+	}
+
+	if val, ok := annotations[prefix.annotation(secretsAnnotation)]; ok {
+		secrets, err := parseSecretManifest(val)
+		if err != nil {
+			return config, fmt.Errorf("invalid %s annotation, expected a YAML or JSON object of variable name to parameter path or {\"path\": ...}: %s", prefix.annotation(secretsAnnotation), err)
+		}
+		config.Secrets = secrets
+	}
+
+	return config, nil
+}
+
+// withAnnotations returns a copy of the settings overridden by the annotations of source,
+// the namespace or pod they were read from
+func (s webhookSettings) withAnnotations(annotations map[string]string, source string) (*webhookSettings, error) {
+	if val, ok := annotations[awsRegionAnnotation]; ok {
+		s.Region = val
+	}
+
+	if val, ok := annotations[ssmEnvImageAnnotation]; ok {
+		if err := validateImage(val); err != nil {
+			return nil, fmt.Errorf("invalid %s annotation on %s: %s", ssmEnvImageAnnotation, source, err)
+		}
+		s.SsmEnvImage = val
+	}
+
+	if val, ok := annotations[roleARNAnnotation]; ok {
+		if err := validateRoleARN(val); err != nil {
+			return nil, fmt.Errorf("invalid %s annotation on %s: %s", roleARNAnnotation, source, err)
+		}
+		s.RoleARN = val
+	}
+
+	for annotation, value := range map[string]*bool{
+		ignoreMissingSecretsAnnotation: &s.IgnoreMissingSecrets,
+		fileModeAnnotation:             &s.FileMode,
+		wrapExecHandlersAnnotation:     &s.WrapExecHandlers,
+	} {
+		if val, ok := annotations[annotation]; ok {
+			b, err := strconv.ParseBool(val)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s annotation on %s, expected true or false: %s", annotation, source, err)
+			}
+			*value = b
+		}
+	}
+
+	return &s, nil
+}
+
+// annotatePod records the injection on a mutated pod. injected-env holds a JSON object of
+// container name to variable names, or to name and path pairs when includePaths is set
+func annotatePod(pod *corev1.Pod, prefix referencePrefix, containers []containerRecord, ssmEnvImage string, includePaths bool, now time.Time) error {
+	var injected interface{}
+	if includePaths {
+		references := map[string][]ssmReference{}
+		for _, container := range containers {
+			references[container.Name] = container.References
+		}
+		injected = references
+	} else {
+		names := map[string][]string{}
+		for _, container := range containers {
+			for _, reference := range container.References {
+				names[container.Name] = append(names[container.Name], reference.Name)
+			}
+		}
+		injected = names
+	}
+	data, err := json.Marshal(injected)
+	if err != nil {
+		return fmt.Errorf("error encoding %s annotation: %s", prefix.annotation(injectedEnvAnnotation), err)
+	}
+
+	if pod.Annotations == nil {
+		pod.Annotations = map[string]string{}
+	}
+	pod.Annotations[prefix.annotation(injectedEnvAnnotation)] = string(data)
+	pod.Annotations[prefix.annotation(injectedSsmEnvImageAnnotation)] = ssmEnvImage
+	pod.Annotations[prefix.annotation(webhookVersionAnnotation)] = version
+	pod.Annotations[prefix.annotation(mutatedAtAnnotation)] = now.UTC().Format(time.RFC3339)
+
+	if pod.Labels == nil {
+		pod.Labels = map[string]string{}
+	}
+	pod.Labels[injectedLabel] = "true"
+
+	return nil
+}
@@ -0,0 +1,78 @@
+// Copyright © 2020 Peter Wilson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	cmp "github.com/google/go-cmp/cmp"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_annotatePod(t *testing.T) {
+	containers := []containerRecord{
+		{Name: "app", References: []ssmReference{{Name: "DB_PASS", Path: "/prod/db/pass"}, {Name: "API_KEY", Path: "/prod/api/key"}}},
+		{Name: "migrate", References: []ssmReference{{Name: "DB_PASS", Path: "/prod/db/pass"}}},
+	}
+	now := time.Date(2020, 4, 1, 10, 0, 0, 0, time.FixedZone("AEST", 10*60*60))
+
+	tests := []struct {
+		name         string
+		includePaths bool
+		wantEnv      string
+	}{
+		{
+			name:    "names only",
+			wantEnv: `{"app":["DB_PASS","API_KEY"],"migrate":["DB_PASS"]}`,
+		},
+		{
+			name:         "names and paths",
+			includePaths: true,
+			wantEnv:      `{"app":[{"name":"DB_PASS","path":"/prod/db/pass"},{"name":"API_KEY","path":"/prod/api/key"}],"migrate":[{"name":"DB_PASS","path":"/prod/db/pass"}]}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+				Labels:      map[string]string{"app": "app"},
+				Annotations: map[string]string{"ssm.pwillie.github.io/ssm-env-image": "registry.local/ssm-env:1.1.0"},
+			}}
+
+			if err := annotatePod(pod, defaultReferencePrefix, containers, "registry.local/ssm-env:1.1.0", tt.includePaths, now); err != nil {
+				t.Fatalf("annotatePod() error = %v", err)
+			}
+
+			// the override is kept as it is, so the pod reads the same when the webhook sees it again
+			wantAnnotations := map[string]string{
+				"ssm.pwillie.github.io/ssm-env-image":          "registry.local/ssm-env:1.1.0",
+				"ssm.pwillie.github.io/injected-env":           tt.wantEnv,
+				"ssm.pwillie.github.io/injected-ssm-env-image": "registry.local/ssm-env:1.1.0",
+				"ssm.pwillie.github.io/webhook-version":        version,
+				"ssm.pwillie.github.io/mutated-at":             "2020-04-01T00:00:00Z",
+			}
+			if !cmp.Equal(pod.Annotations, wantAnnotations) {
+				t.Errorf("annotatePod() annotations diff %v", cmp.Diff(pod.Annotations, wantAnnotations))
+			}
+
+			wantLabels := map[string]string{"app": "app", "ssm.pwillie.github.io/injected": "true"}
+			if !cmp.Equal(pod.Labels, wantLabels) {
+				t.Errorf("annotatePod() labels diff %v", cmp.Diff(pod.Labels, wantLabels))
+			}
+		})
+	}
+}
@@ -0,0 +1,210 @@
+// Copyright © 2020 Peter Wilson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	decisionMutated = "mutated"
+	decisionSkipped = "skipped"
+	decisionDenied  = "denied"
+)
+
+type auditOwner struct {
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+}
+
+// auditEvent records the outcome of a single admission, it never contains parameter values
+type auditEvent struct {
+	Timestamp      time.Time         `json:"timestamp"`
+	UID            string            `json:"uid"`
+	Namespace      string            `json:"namespace"`
+	Pod            string            `json:"pod"`
+	Owner          *auditOwner       `json:"owner,omitempty"`
+	ServiceAccount string            `json:"serviceAccount"`
+	DryRun         bool              `json:"dryRun"`
+	Containers     []containerRecord `json:"containers"`
+	Decision       string            `json:"decision"`
+	Reason         string            `json:"reason,omitempty"`
+	Warnings       []string          `json:"warnings,omitempty"`
+}
+
+func newAuditEvent(uid string, pod *corev1.Pod, ns string, dryRun bool, record *admissionRecord, err error) auditEvent {
+	event := auditEvent{
+		Timestamp:      time.Now().UTC(),
+		UID:            uid,
+		Namespace:      ns,
+		Pod:            pod.Name,
+		ServiceAccount: pod.Spec.ServiceAccountName,
+		DryRun:         dryRun,
+		Containers:     record.mutatedContainers(),
+		Decision:       decisionMutated,
+		Warnings:       record.collectedWarnings(),
+	}
+	if event.Pod == "" {
+		event.Pod = pod.GenerateName
+	}
+	if event.ServiceAccount == "" {
+		event.ServiceAccount = "default"
+	}
+	for _, owner := range pod.OwnerReferences {
+		if owner.Controller != nil && *owner.Controller {
+			event.Owner = &auditOwner{Kind: owner.Kind, Name: owner.Name}
+		}
+	}
+
+	switch {
+	case err != nil:
+		event.Decision = decisionDenied
+		event.Reason = err.Error()
+	case len(event.Containers) == 0:
+		event.Decision = decisionSkipped
+		event.Reason = record.skipped()
+	}
+	return event
+}
+
+// auditSink writes audit events, errors are logged but never fail the admission
+type auditSink interface {
+	write(event auditEvent) error
+}
+
+// newAuditSink creates the sink selected by audit_sink, nil when auditing is disabled
+func newAuditSink(logger logrus.FieldLogger) (auditSink, error) {
+	switch sink := viper.GetString("audit_sink"); sink {
+	case "":
+		return nil, nil
+	case "log":
+		return &logAuditSink{logger: logger}, nil
+	case "file":
+		return newFileAuditSink(viper.GetString("audit_file"))
+	case "http":
+		return newHTTPAuditSink(viper.GetString("audit_http_url"), viper.GetDuration("audit_http_timeout"), logger)
+	default:
+		return nil, fmt.Errorf("invalid audit_sink %q, expected one of log, file, http", sink)
+	}
+}
+
+type logAuditSink struct {
+	logger logrus.FieldLogger
+}
+
+func (s *logAuditSink) write(event auditEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	s.logger.WithField("audit", string(data)).Info("admission decision")
+	return nil
+}
+
+type fileAuditSink struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func newFileAuditSink(path string) (*fileAuditSink, error) {
+	if path == "" {
+		return nil, fmt.Errorf("audit_file is required for the file audit sink")
+	}
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("error opening audit file: %s", err)
+	}
+	return &fileAuditSink{file: file}, nil
+}
+
+func (s *fileAuditSink) write(event auditEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.file.Write(append(data, '\n'))
+	return err
+}
+
+// httpAuditSink posts events to an endpoint from a background worker so a slow
+// endpoint doesn't delay admissions, events are dropped when the queue is full
+type httpAuditSink struct {
+	url    string
+	client *http.Client
+	queue  chan auditEvent
+	logger logrus.FieldLogger
+}
+
+func newHTTPAuditSink(url string, timeout time.Duration, logger logrus.FieldLogger) (*httpAuditSink, error) {
+	if url == "" {
+		return nil, fmt.Errorf("audit_http_url is required for the http audit sink")
+	}
+	s := &httpAuditSink{
+		url:    url,
+		client: &http.Client{Timeout: timeout},
+		queue:  make(chan auditEvent, 1000),
+		logger: logger,
+	}
+	go s.run()
+	return s, nil
+}
+
+func (s *httpAuditSink) write(event auditEvent) error {
+	select {
+	case s.queue <- event:
+		return nil
+	default:
+		return fmt.Errorf("audit queue full, dropping event for %s/%s", event.Namespace, event.Pod)
+	}
+}
+
+func (s *httpAuditSink) run() {
+	for event := range s.queue {
+		if err := s.post(event); err != nil {
+			s.logger.Errorf("error sending audit event for %s/%s: %s", event.Namespace, event.Pod, err)
+		}
+	}
+}
+
+func (s *httpAuditSink) post(event auditEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	res, err := s.client.Post(s.url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", res.Status)
+	}
+	return nil
+}
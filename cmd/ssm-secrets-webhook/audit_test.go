@@ -0,0 +1,89 @@
+// Copyright © 2020 Peter Wilson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	cmp "github.com/google/go-cmp/cmp"
+	imagev1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sirupsen/logrus"
+	whcontext "github.com/slok/kubewebhook/pkg/webhook/context"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	fake "k8s.io/client-go/kubernetes/fake"
+)
+
+type recordingAuditSink struct {
+	events []auditEvent
+}
+
+func (s *recordingAuditSink) write(event auditEvent) error {
+	s.events = append(s.events, event)
+	return nil
+}
+
+func Test_mutatingWebhook_audit(t *testing.T) {
+	sink := &recordingAuditSink{}
+	mw := &mutatingWebhook{
+		k8sClient: fake.NewSimpleClientset(),
+		registry:  &MockRegistry{Image: imagev1.ImageConfig{Entrypoint: []string{"/app"}}},
+		logger:    logrus.New(),
+		auditSink: sink,
+	}
+
+	controller := true
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName:    "app-5d8f7-",
+			OwnerReferences: []metav1.OwnerReference{{Kind: "ReplicaSet", Name: "app-5d8f7", Controller: &controller}},
+		},
+		Spec: corev1.PodSpec{
+			ServiceAccountName: "app",
+			SecurityContext:    &corev1.PodSecurityContext{},
+			Containers: []corev1.Container{
+				{Name: "app", Image: "app", Env: []corev1.EnvVar{{Name: "DB_PASS", Value: "ssm:/prod/db/pass"}, {Name: "PLAIN", Value: "value"}}},
+				{Name: "sidecar", Image: "sidecar"},
+			},
+		},
+	}
+
+	ctx := whcontext.SetAdmissionRequest(context.Background(), &admissionv1beta1.AdmissionRequest{UID: "1234", Namespace: "prod"})
+	if _, err := mw.ssmSecretsMutator(ctx, pod); err != nil {
+		t.Fatalf("ssmSecretsMutator() error = %v", err)
+	}
+
+	if len(sink.events) != 1 {
+		t.Fatalf("ssmSecretsMutator() audit events = %v, want 1", len(sink.events))
+	}
+	event := sink.events[0]
+	event.Timestamp = event.Timestamp.Truncate(0)
+
+	want := auditEvent{
+		Timestamp:      event.Timestamp,
+		UID:            "1234",
+		Namespace:      "prod",
+		Pod:            "app-5d8f7-",
+		Owner:          &auditOwner{Kind: "ReplicaSet", Name: "app-5d8f7"},
+		ServiceAccount: "app",
+		Containers:     []containerRecord{{Name: "app", References: []ssmReference{{Name: "DB_PASS", Path: "/prod/db/pass"}}}},
+		Decision:       decisionMutated,
+	}
+	if !cmp.Equal(event, want) {
+		t.Errorf("ssmSecretsMutator() audit event diff %v", cmp.Diff(event, want))
+	}
+}
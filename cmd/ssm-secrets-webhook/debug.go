@@ -0,0 +1,98 @@
+// Copyright © 2020 Peter Wilson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+)
+
+// mutationEntry is an admission decision kept for /debug/mutations, like audit events
+// it holds parameter paths but never values
+type mutationEntry struct {
+	auditEvent
+	Patch           json.RawMessage `json:"patch,omitempty"`
+	MutationSeconds float64         `json:"mutationSeconds"`
+	RequestSeconds  float64         `json:"requestSeconds"`
+}
+
+// mutationHistory is a ring buffer of the most recent admission decisions
+type mutationHistory struct {
+	mu      sync.Mutex
+	entries []mutationEntry
+	next    int
+	full    bool
+}
+
+// newMutationHistory returns a history of the given size, nil when size is not positive
+func newMutationHistory(size int) *mutationHistory {
+	if size <= 0 {
+		return nil
+	}
+	return &mutationHistory{entries: make([]mutationEntry, size)}
+}
+
+func (h *mutationHistory) add(entry mutationEntry) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.entries[h.next] = entry
+	h.next = (h.next + 1) % len(h.entries)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// list returns the entries of the namespace, or all entries when namespace is empty, newest first
+func (h *mutationHistory) list(namespace string) []mutationEntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	count := h.next
+	if h.full {
+		count = len(h.entries)
+	}
+
+	entries := []mutationEntry{}
+	for i := 1; i <= count; i++ {
+		entry := h.entries[(h.next-i+len(h.entries))%len(h.entries)]
+		if namespace == "" || entry.Namespace == namespace {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+func (h *mutationHistory) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(h.list(r.URL.Query().Get("namespace")))
+}
+
+// admissionPatch returns the JSON patch of a serialized AdmissionReview, nil when there is none
+func admissionPatch(body []byte) json.RawMessage {
+	var review struct {
+		Response struct {
+			Patch []byte `json:"patch"`
+		} `json:"response"`
+	}
+	if err := json.Unmarshal(body, &review); err != nil || !json.Valid(review.Response.Patch) {
+		return nil
+	}
+	return review.Response.Patch
+}
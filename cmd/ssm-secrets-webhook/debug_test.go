@@ -0,0 +1,104 @@
+// Copyright © 2020 Peter Wilson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	cmp "github.com/google/go-cmp/cmp"
+)
+
+func Test_mutationHistory(t *testing.T) {
+	history := newMutationHistory(3)
+	for _, pod := range []struct{ namespace, name string }{
+		{"prod", "a"}, {"dev", "b"}, {"prod", "c"}, {"prod", "d"},
+	} {
+		history.add(mutationEntry{auditEvent: auditEvent{Namespace: pod.namespace, Pod: pod.name}})
+	}
+
+	tests := []struct {
+		name      string
+		namespace string
+		wantPods  []string
+	}{
+		{
+			name:     "all namespaces",
+			wantPods: []string{"d", "c", "b"},
+		},
+		{
+			name:      "namespace",
+			namespace: "prod",
+			wantPods:  []string{"d", "c"},
+		},
+		{
+			name:      "unknown namespace",
+			namespace: "test",
+			wantPods:  []string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			history.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/mutations?namespace="+tt.namespace, nil))
+
+			var entries []mutationEntry
+			if err := json.Unmarshal(rec.Body.Bytes(), &entries); err != nil {
+				t.Fatalf("mutationHistory.ServeHTTP() invalid response %s: %v", rec.Body.String(), err)
+			}
+			pods := []string{}
+			for _, entry := range entries {
+				pods = append(pods, entry.Pod)
+			}
+			if !cmp.Equal(pods, tt.wantPods) {
+				t.Errorf("mutationHistory.ServeHTTP() pods diff %v", cmp.Diff(pods, tt.wantPods))
+			}
+		})
+	}
+}
+
+func Test_admissionPatch(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want json.RawMessage
+	}{
+		{
+			name: "patch",
+			// base64 of [{"op":"add","path":"/metadata/labels","value":{}}]
+			body: `{"response":{"allowed":true,"patch":"W3sib3AiOiJhZGQiLCJwYXRoIjoiL21ldGFkYXRhL2xhYmVscyIsInZhbHVlIjp7fX1d","patchType":"JSONPatch"}}`,
+			want: json.RawMessage(`[{"op":"add","path":"/metadata/labels","value":{}}]`),
+		},
+		{
+			name: "no patch",
+			body: `{"response":{"allowed":false}}`,
+		},
+		{
+			name: "invalid review",
+			body: `not json`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := admissionPatch([]byte(tt.body)); string(got) != string(tt.want) {
+				t.Errorf("admissionPatch() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright © 2020 Peter Wilson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"time"
+
+	imagev1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"go.opentelemetry.io/otel/trace"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// imageEntrypoint is a statically configured entrypoint and cmd of an image
+type imageEntrypoint struct {
+	Entrypoint []string `json:"entrypoint,omitempty"`
+	Cmd        []string `json:"cmd,omitempty"`
+}
+
+// imageEntrypointMapping maps an image pattern (see path.Match) to an entrypoint
+type imageEntrypointMapping struct {
+	Image      string   `json:"image"`
+	Entrypoint []string `json:"entrypoint,omitempty"`
+	Cmd        []string `json:"cmd,omitempty"`
+}
+
+func loadImageEntrypointMappings(file string) ([]imageEntrypointMapping, error) {
+	if file == "" {
+		return nil, nil
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("error reading image entrypoint mapping file %s: %s", file, err)
+	}
+
+	var mappings []imageEntrypointMapping
+	if err := yaml.UnmarshalStrict(data, &mappings); err != nil {
+		return nil, fmt.Errorf("error parsing image entrypoint mapping file %s: %s", file, err)
+	}
+
+	for _, mapping := range mappings {
+		if _, err := path.Match(mapping.Image, ""); err != nil {
+			return nil, fmt.Errorf("invalid image pattern %q in %s: %s", mapping.Image, file, err)
+		}
+	}
+
+	return mappings, nil
+}
+
+func matchImageEntrypoint(mappings []imageEntrypointMapping, image string) *imageEntrypoint {
+	for _, mapping := range mappings {
+		if matched, _ := path.Match(mapping.Image, image); matched {
+			return &imageEntrypoint{Entrypoint: mapping.Entrypoint, Cmd: mapping.Cmd}
+		}
+	}
+	return nil
+}
+
+// getImageConfig looks up the entrypoint and cmd of the container image, preferring the pod
+// annotation, then the static image mapping and only then querying the image registry
+func (mw *mutatingWebhook) getImageConfig(ctx context.Context, container *corev1.Container, podSpec *corev1.PodSpec, settings *webhookSettings, config ssmConfig, ns string) (*imagev1.ImageConfig, error) {
+	if entrypoint, ok := config.Entrypoints[container.Name]; ok {
+		mw.logger.Debugf("using entrypoint of container %s from pod annotation", container.Name)
+		return &imagev1.ImageConfig{Entrypoint: entrypoint.Entrypoint, Cmd: entrypoint.Cmd}, nil
+	}
+
+	if entrypoint := matchImageEntrypoint(settings.ImageEntrypoints, container.Image); entrypoint != nil {
+		mw.logger.Debugf("using entrypoint of image %s from image entrypoint mapping", container.Image)
+		return &imagev1.ImageConfig{Entrypoint: entrypoint.Entrypoint, Cmd: entrypoint.Cmd}, nil
+	}
+
+	_, span := tracer.Start(ctx, "GetImageConfig", trace.WithAttributes(namespaceAttribute.String(ns), containerAttribute.String(container.Name), imageAttribute.String(container.Image)))
+	start := time.Now()
+	imageConfig, err := mw.registry.GetImageConfig(mw.k8sClient, ns, container, podSpec)
+	registryLookupDuration.Observe(time.Since(start).Seconds())
+	endSpan(span, err)
+	if err != nil {
+		registryLookupFailuresTotal.Inc()
+	}
+	return imageConfig, err
+}
+
+func entrypointNotDeterminedError(container *corev1.Container, cause error) error {
+	msg := fmt.Sprintf("ssm-secrets-webhook can't determine the command of container %s (image %s)", container.Name, container.Image)
+	if cause != nil {
+		msg = fmt.Sprintf("%s: %s", msg, cause)
+	}
+	return fmt.Errorf("%s; set an explicit command on the container, add it to the %s pod annotation or to the webhook image entrypoint mapping", msg, entrypointsAnnotation)
+}
@@ -0,0 +1,228 @@
+// Copyright © 2020 Peter Wilson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+type envValue struct {
+	value  string
+	source string
+	// unknown values are only resolved by the kubelet
+	unknown bool
+}
+
+// containerEnv is the environment the kubelet gives a container: envFrom sources in order,
+// then env, with later values overriding earlier ones of the same name
+type containerEnv struct {
+	record *admissionRecord
+	prefix referencePrefix
+	names  []string
+	values map[string]envValue
+}
+
+func newContainerEnv(record *admissionRecord, prefix referencePrefix) *containerEnv {
+	return &containerEnv{record: record, prefix: prefix, values: map[string]envValue{}}
+}
+
+func (e *containerEnv) set(name, value, source string) {
+	e.put(name, envValue{value: value, source: source})
+}
+
+// setUnknown defines a variable whose value isn't known at admission
+func (e *containerEnv) setUnknown(name, source string) {
+	e.put(name, envValue{source: source, unknown: true})
+}
+
+func (e *containerEnv) put(name string, value envValue) {
+	if _, ok := e.values[name]; !ok {
+		e.names = append(e.names, name)
+	}
+	e.values[name] = value
+}
+
+// expand returns a value of env the way the kubelet expands it, against the variables set before
+// it: $(VAR) is replaced by the value of VAR when it is defined, $$ is an escaped $ and anything
+// else is kept as it is. References to variables whose value is unknown are kept as well
+func (e *containerEnv) expand(value string) string {
+	var buf strings.Builder
+	checkpoint := 0
+	for cursor := 0; cursor < len(value)-1; cursor++ {
+		if value[cursor] != '$' {
+			continue
+		}
+		buf.WriteString(value[checkpoint:cursor])
+		switch value[cursor+1] {
+		case '$':
+			buf.WriteByte('$')
+			cursor++
+		case '(':
+			end := strings.IndexByte(value[cursor+2:], ')')
+			if end < 0 {
+				// incomplete reference, kept as it is
+				buf.WriteString("$(")
+				cursor++
+				break
+			}
+			name := value[cursor+2 : cursor+2+end]
+			if defined, ok := e.values[name]; ok && !defined.unknown {
+				buf.WriteString(defined.value)
+			} else {
+				buf.WriteString("$(" + name + ")")
+			}
+			cursor += 2 + end
+		default:
+			buf.WriteString(value[cursor : cursor+2])
+			cursor++
+		}
+		checkpoint = cursor + 1
+	}
+	return buf.String() + value[checkpoint:]
+}
+
+// setFrom sets a key of an envFrom source, the kubelet skips keys that aren't valid variable names
+func (e *containerEnv) setFrom(prefix, key, value, source string) {
+	name := prefix + key
+	if errs := validation.IsEnvVarName(name); len(errs) > 0 {
+		if e.prefix.isReference(value) {
+			e.record.warn("%s is not a valid environment variable name, the ssm reference in it was not injected: %s", name, strings.Join(errs, ", "))
+		}
+		return
+	}
+	e.set(name, value, source)
+}
+
+func (e *containerEnv) defines(name string) bool {
+	_, ok := e.values[name]
+	return ok
+}
+
+func (e *containerEnv) source(name string) string {
+	return e.values[name].source
+}
+
+// references returns the variables holding ssm references, in the order they were first set
+func (e *containerEnv) references() []corev1.EnvVar {
+	var envVars []corev1.EnvVar
+	for _, name := range e.names {
+		value := e.values[name]
+		if e.prefix.isReference(value.value) {
+			envVars = append(envVars, corev1.EnvVar{Name: name, Value: value.value})
+			referencesFoundTotal.WithLabelValues(value.source).Inc()
+		}
+	}
+	return envVars
+}
+
+// hasEscapes reports whether any variable holds an escaped value, which ssm-env unescapes
+func (e *containerEnv) hasEscapes() bool {
+	for _, value := range e.values {
+		if e.prefix.isEscaped(value.value) {
+			return true
+		}
+	}
+	return false
+}
+
+func isOptional(optional *bool) bool {
+	return optional != nil && *optional
+}
+
+func sortedKeys(data map[string]string) []string {
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// argVariables returns the names of the $(VAR) references the kubelet expands in an argument,
+// $$ escapes a reference
+func argVariables(arg string) []string {
+	var names []string
+	for i := 0; i < len(arg)-1; i++ {
+		if arg[i] != '$' {
+			continue
+		}
+		switch arg[i+1] {
+		case '$':
+			i++
+		case '(':
+			end := strings.IndexByte(arg[i+2:], ')')
+			if end < 0 {
+				return names
+			}
+			names = append(names, arg[i+2:i+2+end])
+			i += 2 + end
+		}
+	}
+	return names
+}
+
+// argTemplates returns the arguments, by index, referencing variables that hold ssm references.
+// The kubelet expands them to the references before ssm-env runs, so ssm-env expands them again
+func argTemplates(args []string, envVars []corev1.EnvVar) map[int]string {
+	references := make(map[string]bool, len(envVars))
+	for _, env := range envVars {
+		references[env.Name] = true
+	}
+
+	templates := map[int]string{}
+	for i, arg := range args {
+		for _, name := range argVariables(arg) {
+			if references[name] {
+				templates[i] = arg
+				break
+			}
+		}
+	}
+	return templates
+}
+
+// expandArgsManifest is the SSM_EXPAND_ARGS manifest: the argument templates by index, and the
+// variables of the container spec the kubelet expanded them with, the only ones ssm-env uses
+type expandArgsManifest struct {
+	Args      map[int]string `json:"args"`
+	Variables []string       `json:"variables"`
+}
+
+// templateVariables returns the variables the templates use that are defined in the container,
+// the others are kept as they are by the kubelet
+func (e *containerEnv) templateVariables(templates map[int]string) []string {
+	used := map[string]bool{}
+	for _, template := range templates {
+		for _, name := range argVariables(template) {
+			used[name] = true
+		}
+	}
+	var names []string
+	for _, name := range e.names {
+		if used[name] {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// escapeExpansion keeps the kubelet from expanding $(VAR) references in a variable value
+func escapeExpansion(value string) string {
+	return strings.Replace(value, "$", "$$", -1)
+}
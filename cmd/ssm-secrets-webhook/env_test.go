@@ -0,0 +1,335 @@
+// Copyright © 2020 Peter Wilson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	cmp "github.com/google/go-cmp/cmp"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	fake "k8s.io/client-go/kubernetes/fake"
+)
+
+func Test_mutatingWebhook_lookForContainerEnv(t *testing.T) {
+	optional := true
+	configMapRef := func(name string, opt *bool) *corev1.ConfigMapEnvSource {
+		return &corev1.ConfigMapEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: name}, Optional: opt}
+	}
+	configMapKeyRef := func(name, key string, opt *bool) *corev1.EnvVarSource {
+		return &corev1.EnvVarSource{ConfigMapKeyRef: &corev1.ConfigMapKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: name}, Key: key, Optional: opt}}
+	}
+	secretKeyRef := func(name, key string, opt *bool) *corev1.EnvVarSource {
+		return &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: name}, Key: key, Optional: opt}}
+	}
+
+	mw := &mutatingWebhook{
+		k8sClient: fake.NewSimpleClientset(
+			&corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+				Data:       map[string]string{"PASSWORD": "ssm:/app/password", "USER": "app", "1INVALID": "ssm:/app/invalid"},
+			},
+			&corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Name: "override", Namespace: "default"},
+				Data:       map[string]string{"PASSWORD": "ssm:/override/password", "USER": "ssm:/override/user"},
+			},
+			&corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+				Data:       map[string][]byte{"TOKEN": []byte("ssm:/app/token")},
+			},
+		),
+		logger: logrus.New(),
+	}
+
+	fieldRef := func(path string) *corev1.EnvVarSource {
+		return &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{FieldPath: path}}
+	}
+
+	tests := []struct {
+		name         string
+		podName      string
+		container    corev1.Container
+		manifestVars []corev1.EnvVar
+		want         []corev1.EnvVar
+		wantWarnings int
+	}{
+		{
+			name: "envFrom prefix",
+			container: corev1.Container{EnvFrom: []corev1.EnvFromSource{
+				{Prefix: "DB_", ConfigMapRef: configMapRef("app", nil)},
+			}},
+			want: []corev1.EnvVar{
+				{Name: "DB_1INVALID", Value: "ssm:/app/invalid"},
+				{Name: "DB_PASSWORD", Value: "ssm:/app/password"},
+			},
+		},
+		{
+			name: "invalid variable name",
+			container: corev1.Container{EnvFrom: []corev1.EnvFromSource{
+				{ConfigMapRef: configMapRef("app", nil)},
+				{Prefix: "X_", SecretRef: &corev1.SecretEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "app"}}},
+			}},
+			want: []corev1.EnvVar{
+				{Name: "PASSWORD", Value: "ssm:/app/password"},
+				{Name: "X_TOKEN", Value: "ssm:/app/token"},
+			},
+			wantWarnings: 1,
+		},
+		{
+			name: "later envFrom overrides earlier",
+			container: corev1.Container{EnvFrom: []corev1.EnvFromSource{
+				{ConfigMapRef: configMapRef("override", nil)},
+				{ConfigMapRef: configMapRef("app", nil)},
+			}},
+			want: []corev1.EnvVar{
+				{Name: "PASSWORD", Value: "ssm:/app/password"},
+			},
+			wantWarnings: 1,
+		},
+		{
+			name: "env overrides envFrom",
+			container: corev1.Container{
+				EnvFrom: []corev1.EnvFromSource{{ConfigMapRef: configMapRef("override", nil)}},
+				Env: []corev1.EnvVar{
+					{Name: "PASSWORD", Value: "plain"},
+					{Name: "USER", ValueFrom: &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.name"}}},
+					{Name: "TOKEN", ValueFrom: secretKeyRef("app", "TOKEN", nil)},
+				},
+			},
+			want: []corev1.EnvVar{{Name: "TOKEN", Value: "ssm:/app/token"}},
+		},
+		{
+			name: "env reference overrides plain envFrom value",
+			container: corev1.Container{
+				EnvFrom: []corev1.EnvFromSource{{ConfigMapRef: configMapRef("app", nil)}},
+				Env:     []corev1.EnvVar{{Name: "USER", ValueFrom: configMapKeyRef("override", "USER", nil)}},
+			},
+			want: []corev1.EnvVar{
+				{Name: "PASSWORD", Value: "ssm:/app/password"},
+				{Name: "USER", Value: "ssm:/override/user"},
+			},
+			wantWarnings: 1,
+		},
+		{
+			name: "later env overrides earlier",
+			container: corev1.Container{Env: []corev1.EnvVar{
+				{Name: "PASSWORD", Value: "ssm:/first"},
+				{Name: "PASSWORD", Value: "ssm:/second"},
+				{Name: "USER", Value: "ssm:/user"},
+				{Name: "USER", Value: "plain"},
+			}},
+			want: []corev1.EnvVar{{Name: "PASSWORD", Value: "ssm:/second"}},
+		},
+		{
+			name: "optional sources and keys that don't exist",
+			container: corev1.Container{
+				EnvFrom: []corev1.EnvFromSource{{ConfigMapRef: configMapRef("missing", &optional)}},
+				Env: []corev1.EnvVar{
+					{Name: "A", ValueFrom: configMapKeyRef("missing", "A", &optional)},
+					{Name: "B", ValueFrom: configMapKeyRef("app", "B", &optional)},
+					{Name: "C", ValueFrom: secretKeyRef("app", "C", &optional)},
+				},
+			},
+		},
+		{
+			name: "required sources and keys that don't exist",
+			container: corev1.Container{
+				EnvFrom: []corev1.EnvFromSource{{ConfigMapRef: configMapRef("missing", nil)}},
+				Env: []corev1.EnvVar{
+					{Name: "A", ValueFrom: configMapKeyRef("missing", "A", nil)},
+					{Name: "B", ValueFrom: configMapKeyRef("app", "B", nil)},
+					{Name: "C", ValueFrom: secretKeyRef("app", "C", nil)},
+				},
+			},
+			wantWarnings: 4,
+		},
+		{
+			name: "missing optional key keeps the envFrom value",
+			container: corev1.Container{
+				EnvFrom: []corev1.EnvFromSource{{ConfigMapRef: configMapRef("override", nil)}},
+				Env:     []corev1.EnvVar{{Name: "PASSWORD", ValueFrom: configMapKeyRef("app", "MISSING", &optional)}},
+			},
+			want: []corev1.EnvVar{
+				{Name: "PASSWORD", Value: "ssm:/override/password"},
+				{Name: "USER", Value: "ssm:/override/user"},
+			},
+		},
+		{
+			name: "env values expanded against earlier variables",
+			container: corev1.Container{
+				EnvFrom: []corev1.EnvFromSource{{ConfigMapRef: configMapRef("app", nil)}},
+				Env: []corev1.EnvVar{
+					{Name: "DB_PASSWORD", Value: "$(PASSWORD)"},
+					{Name: "USER_TOKEN", Value: "ssm:/$(USER)/token"},
+					{Name: "BEFORE_NEXT", Value: "$(NEXT)"},
+					{Name: "NEXT", Value: "ssm:/next"},
+					{Name: "ESCAPED", Value: "$$(PASSWORD)"},
+					{Name: "INCOMPLETE", Value: "$(PASSWORD"},
+				},
+			},
+			want: []corev1.EnvVar{
+				{Name: "PASSWORD", Value: "ssm:/app/password"},
+				{Name: "DB_PASSWORD", Value: "ssm:/app/password"},
+				{Name: "USER_TOKEN", Value: "ssm:/app/token"},
+				{Name: "NEXT", Value: "ssm:/next"},
+			},
+			wantWarnings: 1,
+		},
+		{
+			name: "manifest values expanded against envFrom",
+			container: corev1.Container{
+				EnvFrom: []corev1.EnvFromSource{{Prefix: "APP_", ConfigMapRef: configMapRef("app", nil)}},
+				Env:     []corev1.EnvVar{{Name: "TEAM", Value: "team-a"}},
+			},
+			manifestVars: []corev1.EnvVar{
+				{Name: "TOKEN", Value: "ssm:/$(APP_USER)/token"},
+				{Name: "TEAM_TOKEN", Value: "ssm:/$(TEAM)/token"},
+			},
+			want: []corev1.EnvVar{
+				{Name: "APP_1INVALID", Value: "ssm:/app/invalid"},
+				{Name: "APP_PASSWORD", Value: "ssm:/app/password"},
+				{Name: "TOKEN", Value: "ssm:/app/token"},
+				{Name: "TEAM_TOKEN", Value: "ssm:/$(TEAM)/token"},
+			},
+		},
+		{
+			name:    "downward API values",
+			podName: "web-0",
+			container: corev1.Container{
+				Env: []corev1.EnvVar{
+					{Name: "POD_NAMESPACE", ValueFrom: fieldRef("metadata.namespace")},
+					{Name: "POD_NAME", ValueFrom: fieldRef("metadata.name")},
+					{Name: "POD_IP", ValueFrom: fieldRef("status.podIP")},
+					{Name: "CPU", ValueFrom: &corev1.EnvVarSource{ResourceFieldRef: &corev1.ResourceFieldSelector{Resource: "limits.cpu"}}},
+					{Name: "DB", Value: "ssm:/app/$(POD_NAMESPACE)/$(POD_NAME)/db"},
+					{Name: "HOST", Value: "ssm:/hosts/$(POD_IP)"},
+					{Name: "LIMIT", Value: "ssm:/limits/$(CPU)"},
+				},
+			},
+			want: []corev1.EnvVar{
+				{Name: "DB", Value: "ssm:/app/default/web-0/db"},
+				{Name: "HOST", Value: "ssm:/hosts/$(POD_IP)"},
+				{Name: "LIMIT", Value: "ssm:/limits/$(CPU)"},
+			},
+		},
+		{
+			name: "generated pod name",
+			container: corev1.Container{
+				Env: []corev1.EnvVar{
+					{Name: "POD_NAME", ValueFrom: fieldRef("metadata.name")},
+					{Name: "DB", Value: "ssm:/app/$(POD_NAME)/db"},
+				},
+			},
+			want: []corev1.EnvVar{
+				{Name: "DB", Value: "ssm:/app/$(POD_NAME)/db"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			record := &admissionRecord{}
+			env, err := mw.lookForContainerEnv(withAdmissionRecord(context.Background(), record), &tt.container, tt.manifestVars, defaultReferencePrefix, "default", tt.podName)
+			if err != nil {
+				t.Fatalf("mutatingWebhook.lookForContainerEnv() error = %v", err)
+			}
+			if got := env.references(); !cmp.Equal(got, tt.want) {
+				t.Errorf("mutatingWebhook.lookForContainerEnv() diff %v", cmp.Diff(got, tt.want))
+			}
+			if warnings := record.collectedWarnings(); len(warnings) != tt.wantWarnings {
+				t.Errorf("mutatingWebhook.lookForContainerEnv() warnings = %v, want %d", warnings, tt.wantWarnings)
+			}
+		})
+	}
+}
+
+func Test_argReference(t *testing.T) {
+	tests := []struct {
+		arg      string
+		wantPath string
+		wantOk   bool
+	}{
+		{arg: "ssm:/db/pass", wantPath: "/db/pass", wantOk: true},
+		{arg: "--password=ssm:/db/pass", wantPath: "/db/pass", wantOk: true},
+		{arg: "--dsn=postgres://u@h/db?sslmode=ssm:/x", wantPath: "/x", wantOk: true},
+		{arg: "--password"},
+		{arg: "--note=not ssm:/a/reference"},
+		{arg: "ssm::literal"},
+		{arg: "--token=ssm::literal"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.arg, func(t *testing.T) {
+			path, ok := defaultReferencePrefix.argReference(tt.arg)
+			if path != tt.wantPath || ok != tt.wantOk {
+				t.Errorf("argReference() = %v, %v, want %v, %v", path, ok, tt.wantPath, tt.wantOk)
+			}
+		})
+	}
+}
+
+func Test_argTemplates(t *testing.T) {
+	envVars := []corev1.EnvVar{{Name: "DB_PASS", Value: "ssm:/db/pass"}}
+
+	tests := []struct {
+		name string
+		args []string
+		want map[int]string
+	}{
+		{
+			name: "flag and embedded references",
+			args: []string{"/bin/db", "--password=$(DB_PASS)", "--dsn=postgres://app:$(DB_PASS)@db/app", "--user=$(USER)"},
+			want: map[int]string{1: "--password=$(DB_PASS)", 2: "--dsn=postgres://app:$(DB_PASS)@db/app"},
+		},
+		{
+			name: "escaped and incomplete references",
+			args: []string{"$$(DB_PASS)", "$(DB_PASS", "$$$(DB_PASS)"},
+			want: map[int]string{2: "$$$(DB_PASS)"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := argTemplates(tt.args, envVars); !cmp.Equal(got, tt.want) {
+				t.Errorf("argTemplates() diff %v", cmp.Diff(got, tt.want))
+			}
+		})
+	}
+}
+
+func Test_escapeExpansion(t *testing.T) {
+	if got, want := escapeExpansion(`{"1":"--password=$(DB_PASS) $$"}`), `{"1":"--password=$$(DB_PASS) $$$$"}`; got != want {
+		t.Errorf("escapeExpansion() = %v, want %v", got, want)
+	}
+}
+
+func Test_containerEnv_templateVariables(t *testing.T) {
+	env := newContainerEnv(&admissionRecord{}, defaultReferencePrefix)
+	env.set("USER", "app", sourceEnv)
+	env.set("DB_PASS", "ssm:/db/pass", sourceEnv)
+	env.set("UNUSED", "ssm:/unused", sourceEnv)
+
+	templates := map[int]string{
+		1: "--dsn=postgres://$(USER):$(DB_PASS)@db/app",
+		2: "--password=$(DB_PASS)",
+		3: "$(UNDEFINED) $$(USER)",
+	}
+	want := []string{"USER", "DB_PASS"}
+	if got := env.templateVariables(templates); !cmp.Equal(got, want) {
+		t.Errorf("containerEnv.templateVariables() diff %v", cmp.Diff(got, want))
+	}
+}
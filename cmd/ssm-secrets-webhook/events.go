@@ -0,0 +1,182 @@
+// Copyright © 2020 Peter Wilson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	k8sscheme "k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	warningPrefix = "ssm-secrets-webhook: "
+
+	reasonInjectionWarning = "SsmInjectionWarning"
+	reasonInjectionSkipped = "SsmInjectionSkipped"
+)
+
+// eventEmitter records Kubernetes Events on the workload owning an admitted pod,
+// as the pod itself usually doesn't exist yet at admission time
+type eventEmitter struct {
+	k8sClient kubernetes.Interface
+	recorder  record.EventRecorder
+	logger    logrus.FieldLogger
+}
+
+func newEventEmitter(k8sClient kubernetes.Interface, logger logrus.FieldLogger) *eventEmitter {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: k8sClient.CoreV1().Events("")})
+
+	return &eventEmitter{
+		k8sClient: k8sClient,
+		recorder:  broadcaster.NewRecorder(k8sscheme.Scheme, corev1.EventSource{Component: "ssm-secrets-webhook"}),
+		logger:    logger,
+	}
+}
+
+// ownerReference returns the controller of the pod, resolving ReplicaSets to their Deployment
+func (e *eventEmitter) ownerReference(pod *corev1.Pod, ns string) *corev1.ObjectReference {
+	owner := metav1.GetControllerOf(pod)
+	if owner == nil {
+		return nil
+	}
+
+	if owner.Kind == "ReplicaSet" {
+		rs, err := e.k8sClient.AppsV1().ReplicaSets(ns).Get(owner.Name, metav1.GetOptions{})
+		if err == nil {
+			if deployment := metav1.GetControllerOf(rs); deployment != nil {
+				owner = deployment
+			}
+		} else {
+			e.logger.Debugf("error resolving owner of replicaset %s/%s: %s", ns, owner.Name, err)
+		}
+	}
+
+	return &corev1.ObjectReference{
+		APIVersion: owner.APIVersion,
+		Kind:       owner.Kind,
+		Name:       owner.Name,
+		Namespace:  ns,
+		UID:        owner.UID,
+	}
+}
+
+func (e *eventEmitter) emit(pod *corev1.Pod, ns string, eventType, reason string, messages []string) {
+	if e == nil || len(messages) == 0 {
+		return
+	}
+
+	ref := e.ownerReference(pod, ns)
+	if ref == nil {
+		e.logger.Debugf("pod in namespace %s has no owner, not recording %s events", ns, reason)
+		return
+	}
+
+	for _, message := range messages {
+		e.recorder.Event(ref, eventType, reason, message)
+	}
+}
+
+// responseBuffer holds the response of the wrapped handler so it can be amended
+type responseBuffer struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *responseBuffer) Header() http.Header            { return b.header }
+func (b *responseBuffer) Write(data []byte) (int, error) { return b.body.Write(data) }
+func (b *responseBuffer) WriteHeader(status int)         { b.status = status }
+
+// admissionHandler attaches an admissionRecord to the request and adds the warnings collected
+// while mutating to the AdmissionReview response, where kubectl displays them. The decision and
+// the patch returned are kept in history
+func admissionHandler(handler http.Handler, history *mutationHistory) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		admission := &admissionRecord{}
+		buffer := &responseBuffer{header: http.Header{}, status: http.StatusOK}
+
+		handler.ServeHTTP(buffer, r.WithContext(withAdmissionRecord(r.Context(), admission)))
+
+		body := buffer.body.Bytes()
+		if event, duration := admission.decision(); event != nil && history != nil {
+			history.add(mutationEntry{
+				auditEvent:      *event,
+				Patch:           admissionPatch(body),
+				MutationSeconds: duration.Seconds(),
+				RequestSeconds:  time.Since(start).Seconds(),
+			})
+		}
+
+		warnings := admission.collectedWarnings()
+		if reason := admission.skipped(); reason != "" {
+			warnings = append(warnings, "pod was not mutated, "+reason)
+		}
+		if len(warnings) > 0 {
+			body = addAdmissionWarnings(body, warnings)
+		}
+
+		for key, values := range buffer.header {
+			w.Header()[key] = values
+		}
+		w.WriteHeader(buffer.status)
+		_, _ = w.Write(body)
+	})
+}
+
+// addAdmissionWarnings sets response.warnings of a serialized AdmissionReview, the body is
+// returned as is when it can't be amended
+func addAdmissionWarnings(body []byte, warnings []string) []byte {
+	var review map[string]json.RawMessage
+	if err := json.Unmarshal(body, &review); err != nil {
+		return body
+	}
+	var response map[string]json.RawMessage
+	if err := json.Unmarshal(review["response"], &response); err != nil {
+		return body
+	}
+
+	prefixed := make([]string, 0, len(warnings))
+	for _, warning := range warnings {
+		if !strings.HasPrefix(warning, warningPrefix) {
+			warning = warningPrefix + warning
+		}
+		prefixed = append(prefixed, warning)
+	}
+
+	var err error
+	if response["warnings"], err = json.Marshal(prefixed); err != nil {
+		return body
+	}
+	if review["response"], err = json.Marshal(response); err != nil {
+		return body
+	}
+	amended, err := json.Marshal(review)
+	if err != nil {
+		return body
+	}
+	return amended
+}
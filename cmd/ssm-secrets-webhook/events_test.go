@@ -0,0 +1,150 @@
+// Copyright © 2020 Peter Wilson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	cmp "github.com/google/go-cmp/cmp"
+	"github.com/sirupsen/logrus"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	fake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+func Test_admissionHandler(t *testing.T) {
+	tests := []struct {
+		name         string
+		warnings     []string
+		skip         string
+		wantWarnings []string
+	}{
+		{
+			name: "no warnings",
+		},
+		{
+			name:         "warnings",
+			warnings:     []string{"configmap prod/app was not found"},
+			wantWarnings: []string{"ssm-secrets-webhook: configmap prod/app was not found"},
+		},
+		{
+			name:         "skipped",
+			skip:         "injection is disabled",
+			wantWarnings: []string{"ssm-secrets-webhook: pod was not mutated, injection is disabled"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := admissionHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				record := admissionRecordFrom(r.Context())
+				for _, warning := range tt.warnings {
+					record.warn(warning)
+				}
+				if tt.skip != "" {
+					record.skip(tt.skip)
+				}
+				w.Header().Set("Content-Type", "application/json")
+				_, _ = w.Write([]byte(`{"kind":"AdmissionReview","response":{"uid":"1234","allowed":true}}`))
+			}), nil)
+
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/pods", nil))
+
+			if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/json" {
+				t.Errorf("admissionHandler() status = %v, content type = %v", rec.Code, rec.Header().Get("Content-Type"))
+			}
+
+			var review struct {
+				Kind     string `json:"kind"`
+				Response struct {
+					UID      string   `json:"uid"`
+					Allowed  bool     `json:"allowed"`
+					Warnings []string `json:"warnings"`
+				} `json:"response"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &review); err != nil {
+				t.Fatalf("admissionHandler() invalid response %s: %v", rec.Body.String(), err)
+			}
+			if review.Kind != "AdmissionReview" || review.Response.UID != "1234" || !review.Response.Allowed {
+				t.Errorf("admissionHandler() response altered: %s", rec.Body.String())
+			}
+			if !cmp.Equal(review.Response.Warnings, tt.wantWarnings) {
+				t.Errorf("admissionHandler() warnings diff %v", cmp.Diff(review.Response.Warnings, tt.wantWarnings))
+			}
+		})
+	}
+}
+
+func Test_eventEmitter_emit(t *testing.T) {
+	controller := true
+	rs := &appsv1.ReplicaSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "app-5d8f7",
+			Namespace:       "prod",
+			OwnerReferences: []metav1.OwnerReference{{APIVersion: "apps/v1", Kind: "Deployment", Name: "app", UID: "5678", Controller: &controller}},
+		},
+	}
+
+	tests := []struct {
+		name       string
+		owner      []metav1.OwnerReference
+		wantEvents int
+		wantKind   string
+	}{
+		{
+			name:       "deployment",
+			owner:      []metav1.OwnerReference{{APIVersion: "apps/v1", Kind: "ReplicaSet", Name: "app-5d8f7", Controller: &controller}},
+			wantEvents: 1,
+			wantKind:   "Deployment",
+		},
+		{
+			name:       "statefulset",
+			owner:      []metav1.OwnerReference{{APIVersion: "apps/v1", Kind: "StatefulSet", Name: "db", Controller: &controller}},
+			wantEvents: 1,
+			wantKind:   "StatefulSet",
+		},
+		{
+			name:       "no owner",
+			wantEvents: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := record.NewFakeRecorder(10)
+			e := &eventEmitter{
+				k8sClient: fake.NewSimpleClientset(rs),
+				recorder:  recorder,
+				logger:    logrus.New(),
+			}
+			pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{GenerateName: "app-", OwnerReferences: tt.owner}}
+
+			if ref := e.ownerReference(pod, "prod"); ref != nil && ref.Kind != tt.wantKind {
+				t.Errorf("eventEmitter.ownerReference() kind = %v, want %v", ref.Kind, tt.wantKind)
+			}
+
+			e.emit(pod, "prod", corev1.EventTypeWarning, reasonInjectionWarning, []string{"secret prod/app was not found"})
+			if len(recorder.Events) != tt.wantEvents {
+				t.Errorf("eventEmitter.emit() events = %v, want %v", len(recorder.Events), tt.wantEvents)
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright © 2020 Peter Wilson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// sources of the lookups made while mutating a pod, each has its own failure mode
+const (
+	lookupSourceConfigMap = "configmap"
+	lookupSourceSecret    = "secret"
+	lookupSourceRegistry  = "registry"
+)
+
+// lookupError is a failed ConfigMap, Secret or registry lookup
+type lookupError struct {
+	source string
+	err    error
+}
+
+func (e *lookupError) Error() string {
+	return e.err.Error()
+}
+
+func (e *lookupError) Unwrap() error {
+	return e.err
+}
+
+// parseLookupFailureMode accepts the failure modes of lookups, where AdmitPartial is valid too
+func parseLookupFailureMode(value string) (failureMode, error) {
+	switch mode := failureMode(value); mode {
+	case failureModeFail, failureModeAdmitUnmutated, failureModeAdmitPartial:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("invalid failure mode %q, expected one of %s, %s, %s", value, failureModeFail, failureModeAdmitUnmutated, failureModeAdmitPartial)
+	}
+}
+
+// lookupFailureMode returns the failure mode of the source, Fail when it isn't set
+func (s *webhookSettings) lookupFailureMode(source string) failureMode {
+	var mode failureMode
+	switch source {
+	case lookupSourceConfigMap:
+		mode = s.ConfigMapFailureMode
+	case lookupSourceSecret:
+		mode = s.SecretFailureMode
+	case lookupSourceRegistry:
+		mode = s.RegistryFailureMode
+	}
+	if mode == "" {
+		return failureModeFail
+	}
+	return mode
+}
+
+// withFailureModeAnnotations applies the failure mode annotations of a namespace, pods can't
+// override them
+func (s webhookSettings) withFailureModeAnnotations(annotations map[string]string, source string) (*webhookSettings, error) {
+	for annotation, value := range map[string]*failureMode{
+		configMapFailureModeAnnotation: &s.ConfigMapFailureMode,
+		secretFailureModeAnnotation:    &s.SecretFailureMode,
+		registryFailureModeAnnotation:  &s.RegistryFailureMode,
+	} {
+		if val, ok := annotations[annotation]; ok {
+			mode, err := parseLookupFailureMode(val)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s annotation on %s: %s", annotation, source, err)
+			}
+			*value = mode
+		}
+	}
+	return &s, nil
+}
+
+// admitPartially leaves the container unmutated when err is a lookup failing in the
+// AdmitPartial mode, it returns err for any other error
+func admitPartially(record *admissionRecord, settings *webhookSettings, container string, err error) error {
+	var lookupErr *lookupError
+	if !errors.As(err, &lookupErr) {
+		return err
+	}
+	mode := settings.lookupFailureMode(lookupErr.source)
+	if mode != failureModeAdmitPartial {
+		return err
+	}
+	record.degrade(lookupErr.source, mode)
+	record.warn("container %s was not mutated, a %s lookup failed and the %s failure mode admits the rest of the pod: %s", container, lookupErr.source, mode, err)
+	return nil
+}
+
+// admitUnmutated reports whether err is a lookup failing in the AdmitUnmutated mode
+func admitUnmutated(record *admissionRecord, settings *webhookSettings, err error) bool {
+	var lookupErr *lookupError
+	if !errors.As(err, &lookupErr) {
+		return false
+	}
+	mode := settings.lookupFailureMode(lookupErr.source)
+	if mode != failureModeAdmitUnmutated {
+		return false
+	}
+	record.degrade(lookupErr.source, mode)
+	return true
+}
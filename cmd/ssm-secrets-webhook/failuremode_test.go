@@ -0,0 +1,204 @@
+// Copyright © 2020 Peter Wilson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	cmp "github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	imagev1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	fake "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func Test_mutatingWebhook_mutatePod_lookupFailureMode(t *testing.T) {
+	tests := []struct {
+		name          string
+		settings      webhookSettings
+		registryErr   error
+		wantErr       bool
+		wantMutated   []string
+		wantDegraded  map[string]failureMode
+		wantWarnings  int
+		wantSkipped   bool
+		forbidConfigs bool
+	}{
+		{
+			name:          "configmap lookup fails",
+			forbidConfigs: true,
+			wantErr:       true,
+		},
+		{
+			name:          "configmap lookup admits unmutated",
+			settings:      webhookSettings{ConfigMapFailureMode: failureModeAdmitUnmutated},
+			forbidConfigs: true,
+			wantSkipped:   true,
+			wantDegraded:  map[string]failureMode{lookupSourceConfigMap: failureModeAdmitUnmutated},
+		},
+		{
+			name:          "configmap lookup admits partially",
+			settings:      webhookSettings{ConfigMapFailureMode: failureModeAdmitPartial},
+			forbidConfigs: true,
+			wantMutated:   []string{"sidecar"},
+			wantDegraded:  map[string]failureMode{lookupSourceConfigMap: failureModeAdmitPartial},
+			wantWarnings:  1,
+		},
+		{
+			name:          "failure mode of another source",
+			settings:      webhookSettings{RegistryFailureMode: failureModeAdmitPartial},
+			forbidConfigs: true,
+			wantErr:       true,
+		},
+		{
+			name:         "registry lookup admits partially",
+			settings:     webhookSettings{RegistryFailureMode: failureModeAdmitPartial},
+			registryErr:  &registryUnavailableError{err: errors.New("cannot download manifest for image: timeout")},
+			wantMutated:  []string{"app"},
+			wantDegraded: map[string]failureMode{lookupSourceRegistry: failureModeAdmitPartial},
+			wantWarnings: 1,
+		},
+		{
+			name:        "invalid pull secret fails",
+			settings:    webhookSettings{RegistryFailureMode: failureModeAdmitPartial},
+			registryErr: errors.New("cannot read imagePullSecret 'pull' in namespace 'default': not found"),
+			wantErr:     true,
+		},
+		{
+			name:        "strict entrypoint resolution fails",
+			settings:    webhookSettings{RegistryFailureMode: failureModeAdmitPartial, StrictEntrypointResolution: true},
+			registryErr: &registryUnavailableError{err: errors.New("cannot download manifest for image: timeout")},
+			wantErr:     true,
+		},
+		{
+			name:        "no failure",
+			wantMutated: []string{"app", "sidecar"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k8sClient := fake.NewSimpleClientset(&corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Name: "config", Namespace: "default"},
+				Data:       map[string]string{"password": "ssm:/app/password"},
+			})
+			if tt.forbidConfigs {
+				k8sClient.PrependReactor("get", "configmaps", func(k8stesting.Action) (bool, runtime.Object, error) {
+					return true, nil, apierrors.NewForbidden(schema.GroupResource{Resource: "configmaps"}, "config", errors.New("denied"))
+				})
+			}
+			mw := &mutatingWebhook{
+				k8sClient: k8sClient,
+				registry:  &MockRegistry{Image: imagev1.ImageConfig{Entrypoint: []string{"/sidecar"}}, Err: tt.registryErr},
+				logger:    logrus.New(),
+			}
+			settings := tt.settings
+			settings.SsmEnvImage = "pwillie/ssm-env:latest"
+			mw.settings.Store(&settings)
+
+			pod := &corev1.Pod{
+				Spec: corev1.PodSpec{
+					SecurityContext: &corev1.PodSecurityContext{},
+					Containers: []corev1.Container{
+						{
+							Name:    "app",
+							Image:   "app",
+							Command: []string{"/app"},
+							Env: []corev1.EnvVar{{Name: "PASSWORD", ValueFrom: &corev1.EnvVarSource{
+								ConfigMapKeyRef: &corev1.ConfigMapKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: "config"}, Key: "password"},
+							}}},
+						},
+						{Name: "sidecar", Image: "sidecar", Env: []corev1.EnvVar{{Name: "TOKEN", Value: "ssm:/sidecar/token"}}},
+					},
+				},
+			}
+
+			record := &admissionRecord{}
+			err := mw.mutatePod(withAdmissionRecord(context.Background(), record), pod, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}}, false)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("mutatingWebhook.mutatePod() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			var mutated []string
+			for _, container := range pod.Spec.Containers {
+				if len(container.Command) > 0 && container.Command[0] == "/mutate/ssm-env" {
+					mutated = append(mutated, container.Name)
+				}
+			}
+			if !cmp.Equal(mutated, tt.wantMutated) {
+				t.Errorf("mutatingWebhook.mutatePod() mutated containers = %v, want %v", mutated, tt.wantMutated)
+			}
+			if degraded := record.degradations(); !cmp.Equal(degraded, tt.wantDegraded, cmpopts.EquateEmpty()) {
+				t.Errorf("mutatingWebhook.mutatePod() degraded = %v, want %v", degraded, tt.wantDegraded)
+			}
+			if warnings := record.collectedWarnings(); len(warnings) != tt.wantWarnings {
+				t.Errorf("mutatingWebhook.mutatePod() warnings = %v, want %d", warnings, tt.wantWarnings)
+			}
+			if skipped := record.skipped() != ""; skipped != tt.wantSkipped {
+				t.Errorf("mutatingWebhook.mutatePod() skipped = %v, want %v", skipped, tt.wantSkipped)
+			}
+		})
+	}
+}
+
+func Test_webhookSettings_withFailureModeAnnotations(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		want        *webhookSettings
+		wantErr     bool
+	}{
+		{
+			name: "no annotations",
+			want: &webhookSettings{RegistryFailureMode: failureModeFail},
+		},
+		{
+			name: "namespace modes",
+			annotations: map[string]string{
+				"ssm.pwillie.github.io/registry-failure-mode":  "AdmitPartial",
+				"ssm.pwillie.github.io/configmap-failure-mode": "AdmitUnmutated",
+			},
+			want: &webhookSettings{RegistryFailureMode: failureModeAdmitPartial, ConfigMapFailureMode: failureModeAdmitUnmutated},
+		},
+		{
+			name:        "invalid mode",
+			annotations: map[string]string{"ssm.pwillie.github.io/secret-failure-mode": "Ignore"},
+			wantErr:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := webhookSettings{RegistryFailureMode: failureModeFail}.withFailureModeAnnotations(tt.annotations, "namespace default")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("webhookSettings.withFailureModeAnnotations() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !cmp.Equal(got, tt.want) {
+				t.Errorf("webhookSettings.withFailureModeAnnotations() diff %v", cmp.Diff(got, tt.want))
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright © 2020 Peter Wilson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	corev1 "k8s.io/api/core/v1"
+)
+
+// execHandlerArg tells ssm-env it runs a probe or lifecycle hook rather than the container process
+const execHandlerArg = "--exec-handler"
+
+// secretCacheDir holds the values cached by ssm-env for exec handlers, one directory per container,
+// in the mutate directory of the webhook
+const secretCacheDir = "cache/"
+
+// wrapExecHandlers runs the exec probes and lifecycle hooks of the container through ssm-env,
+// so they see the secrets the container process sees. It reports whether any were wrapped
+func wrapExecHandlers(container *corev1.Container, prefix referencePrefix) bool {
+	wrapped := false
+	for _, handler := range []*corev1.Handler{
+		probeHandler(container.LivenessProbe),
+		probeHandler(container.ReadinessProbe),
+		probeHandler(container.StartupProbe),
+		lifecycleHandler(container.Lifecycle, true),
+		lifecycleHandler(container.Lifecycle, false),
+	} {
+		if handler == nil || handler.Exec == nil || len(handler.Exec.Command) == 0 {
+			continue
+		}
+		handler.Exec.Command = append([]string{prefix.ssmEnvPath(), execHandlerArg}, handler.Exec.Command...)
+		wrapped = true
+	}
+	return wrapped
+}
+
+func probeHandler(probe *corev1.Probe) *corev1.Handler {
+	if probe == nil {
+		return nil
+	}
+	return &probe.Handler
+}
+
+func lifecycleHandler(lifecycle *corev1.Lifecycle, postStart bool) *corev1.Handler {
+	if lifecycle == nil {
+		return nil
+	}
+	if postStart {
+		return lifecycle.PostStart
+	}
+	return lifecycle.PreStop
+}
@@ -0,0 +1,96 @@
+// Copyright © 2020 Peter Wilson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+
+	cmp "github.com/google/go-cmp/cmp"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+func Test_wrapExecHandlers(t *testing.T) {
+	exec := func(command ...string) corev1.Handler {
+		return corev1.Handler{Exec: &corev1.ExecAction{Command: command}}
+	}
+	httpGet := corev1.Handler{HTTPGet: &corev1.HTTPGetAction{Path: "/healthz", Port: intstr.FromInt(8080)}}
+
+	tests := []struct {
+		name        string
+		prefix      referencePrefix
+		container   corev1.Container
+		want        corev1.Container
+		wantWrapped bool
+	}{
+		{
+			name:   "probes and hooks",
+			prefix: defaultReferencePrefix,
+			container: corev1.Container{
+				LivenessProbe:  &corev1.Probe{Handler: exec("/check", "--live")},
+				ReadinessProbe: &corev1.Probe{Handler: httpGet},
+				StartupProbe:   &corev1.Probe{Handler: exec("/check", "--started")},
+				Lifecycle: &corev1.Lifecycle{
+					PostStart: &corev1.Handler{Exec: &corev1.ExecAction{Command: []string{"/migrate"}}},
+					PreStop:   &corev1.Handler{Exec: &corev1.ExecAction{Command: []string{"/drain"}}},
+				},
+			},
+			want: corev1.Container{
+				LivenessProbe:  &corev1.Probe{Handler: exec("/mutate/ssm-env", "--exec-handler", "/check", "--live")},
+				ReadinessProbe: &corev1.Probe{Handler: httpGet},
+				StartupProbe:   &corev1.Probe{Handler: exec("/mutate/ssm-env", "--exec-handler", "/check", "--started")},
+				Lifecycle: &corev1.Lifecycle{
+					PostStart: &corev1.Handler{Exec: &corev1.ExecAction{Command: []string{"/mutate/ssm-env", "--exec-handler", "/migrate"}}},
+					PreStop:   &corev1.Handler{Exec: &corev1.ExecAction{Command: []string{"/mutate/ssm-env", "--exec-handler", "/drain"}}},
+				},
+			},
+			wantWrapped: true,
+		},
+		{
+			name:   "configured prefix",
+			prefix: "ssm-eu:",
+			container: corev1.Container{
+				LivenessProbe: &corev1.Probe{Handler: exec("/mutate/ssm-env", "--exec-handler", "/check")},
+			},
+			want: corev1.Container{
+				LivenessProbe: &corev1.Probe{Handler: exec("/mutate-ssm-eu/ssm-env", "--exec-handler", "/mutate/ssm-env", "--exec-handler", "/check")},
+			},
+			wantWrapped: true,
+		},
+		{
+			name:   "no exec handlers",
+			prefix: defaultReferencePrefix,
+			container: corev1.Container{
+				ReadinessProbe: &corev1.Probe{Handler: httpGet},
+				Lifecycle:      &corev1.Lifecycle{},
+			},
+			want: corev1.Container{
+				ReadinessProbe: &corev1.Probe{Handler: httpGet},
+				Lifecycle:      &corev1.Lifecycle{},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := wrapExecHandlers(&tt.container, tt.prefix); got != tt.wantWrapped {
+				t.Errorf("wrapExecHandlers() = %v, want %v", got, tt.wantWrapped)
+			}
+			if !cmp.Equal(tt.container, tt.want) {
+				t.Errorf("wrapExecHandlers() diff %v", cmp.Diff(tt.container, tt.want))
+			}
+		})
+	}
+}
@@ -20,11 +20,16 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/banzaicloud/bank-vaults/cmd/vault-secrets-webhook/registry"
 	"github.com/prometheus/client_golang/prometheus"
@@ -35,31 +40,99 @@ import (
 	whcontext "github.com/slok/kubewebhook/pkg/webhook/context"
 	"github.com/slok/kubewebhook/pkg/webhook/mutating"
 	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel/trace"
 	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
 	kubernetesConfig "sigs.k8s.io/controller-runtime/pkg/client/config"
 )
 
 const (
 	ec2MetaDataServiceURL = "http://169.254.169.254/latest/dynamic/instance-identity/document"
+
+	// secretFileDir holds a directory per container for values written by ssm-env in file mode,
+	// in the mutate directory of the webhook
+	secretFileDir = "secrets/"
 )
 
+// version is set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
 func init() {
-	viper.SetDefault("aws_region", "")
-	viper.SetDefault("ssm_env_image", "pwillie/ssm-env:latest")
-	viper.SetDefault("ssm_env_image_pull_policy", string(corev1.PullIfNotPresent))
-	viper.SetDefault("ssm_ignore_missing_secrets", "false")
-	viper.SetDefault("listen_address", ":8443")
-	viper.SetDefault("telemetry_listen_address", "")
-	viper.SetDefault("debug", "false")
-	viper.SetDefault("enable_json_log", "false")
+	setDefaults(viper.GetViper())
 	viper.AutomaticEnv()
 }
 
-func hasSsmPrefix(value string) bool {
-	return strings.HasPrefix(value, "ssm:")
+// setDefaults declares the settings of the webhook with their defaults, on the global viper at
+// startup and on the private one a config file change is read into
+func setDefaults(v *viper.Viper) {
+	v.SetDefault("config_file", "")
+	v.SetDefault("aws_region", "")
+	v.SetDefault("ssm_env_image", "pwillie/ssm-env:latest")
+	v.SetDefault("ssm_env_image_pull_policy", string(corev1.PullIfNotPresent))
+	v.SetDefault("ssm_ignore_missing_secrets", "false")
+	v.SetDefault("ssm_role_arn", "")
+	v.SetDefault("ssm_file_mode", "false")
+	v.SetDefault("informer_resync_period", "10m")
+	v.SetDefault("informer_sync_timeout", "30s")
+	v.SetDefault("enable_injection_policies", "false")
+	v.SetDefault("image_entrypoint_mapping_file", "")
+	v.SetDefault("strict_entrypoint_resolution", "false")
+	v.SetDefault("configmap_failure_mode", string(failureModeFail))
+	v.SetDefault("secret_failure_mode", string(failureModeFail))
+	v.SetDefault("registry_failure_mode", string(failureModeFail))
+	v.SetDefault("wrap_exec_handlers", "false")
+	v.SetDefault("exec_handler_cache_ttl", "30s")
+	v.SetDefault("relative_path_template", "")
+	v.SetDefault("cluster_name", "")
+	v.SetDefault("reference_prefix", string(defaultReferencePrefix))
+	v.SetDefault("default_image_platform", "linux/amd64")
+	v.SetDefault("default_image_pull_secret", "")
+	v.SetDefault("default_image_pull_secret_namespace", "")
+	v.SetDefault("registry_skip_verify", "false")
+	v.SetDefault("registry_cache_ttl", "1h")
+	v.SetDefault("annotate_reference_paths", "false")
+	v.SetDefault("listen_address", ":8443")
+	v.SetDefault("tls_cert_file", "")
+	v.SetDefault("tls_private_key_file", "")
+	v.SetDefault("tls_auto_generate", "false")
+	v.SetDefault("tls_secret_name", "ssm-secrets-webhook-tls")
+	v.SetDefault("tls_secret_namespace", "")
+	v.SetDefault("tls_service_name", "ssm-secrets-webhook")
+	v.SetDefault("mutating_webhook_configuration_name", "ssm-secrets-webhook")
+	v.SetDefault("tls_cert_validity", "8760h")
+	v.SetDefault("tls_ca_validity", "87600h")
+	v.SetDefault("tls_rotate_before", "720h")
+	v.SetDefault("tls_refresh_interval", "1h")
+	v.SetDefault("tls_min_version", "1.2")
+	v.SetDefault("tls_cipher_suites", "")
+	v.SetDefault("tls_curve_preferences", "")
+	v.SetDefault("tls_verify_client_cert", "false")
+	v.SetDefault("tls_client_ca_file", "")
+	v.SetDefault("tls_client_allowed_names", "")
+	v.SetDefault("telemetry_listen_address", "")
+	v.SetDefault("server_read_timeout", "15s")
+	v.SetDefault("server_read_header_timeout", "5s")
+	v.SetDefault("server_write_timeout", "30s")
+	v.SetDefault("server_idle_timeout", "60s")
+	v.SetDefault("shutdown_delay", "5s")
+	v.SetDefault("shutdown_grace_period", "30s")
+	v.SetDefault("enable_pprof", "false")
+	v.SetDefault("debug_mutations_history_size", "100")
+	v.SetDefault("readiness_check_timeout", "5s")
+	v.SetDefault("audit_sink", "")
+	v.SetDefault("audit_file", "")
+	v.SetDefault("audit_http_url", "")
+	v.SetDefault("audit_http_timeout", "5s")
+	v.SetDefault("tracing_exporter", "")
+	v.SetDefault("tracing_otlp_endpoint", "localhost:4318")
+	v.SetDefault("tracing_otlp_insecure", "false")
+	v.SetDefault("tracing_sample_ratio", "1.0")
+	v.SetDefault("debug", "false")
+	v.SetDefault("enable_json_log", "false")
 }
 
 func getCurrentAwsRegion(logger logrus.FieldLogger) (string, error) {
@@ -92,162 +165,281 @@ func getCurrentAwsRegion(logger logrus.FieldLogger) (string, error) {
 }
 
 type mutatingWebhook struct {
-	k8sClient kubernetes.Interface
-	registry  registry.ImageRegistry
-	logger    logrus.FieldLogger
-	region    string
+	k8sClient  kubernetes.Interface
+	registry   registry.ImageRegistry
+	logger     logrus.FieldLogger
+	settings   atomic.Value
+	namespaces corelisters.NamespaceLister
+	policies   *policyStore
+	auditSink  auditSink
+	events     *eventEmitter
+	history    *mutationHistory
 }
 
 func (mw *mutatingWebhook) ssmSecretsMutator(ctx context.Context, obj metav1.Object) (bool, error) {
 	switch v := obj.(type) {
 	case *corev1.Pod:
-		return false, mw.mutatePod(v, whcontext.GetAdmissionRequest(ctx).Namespace, whcontext.IsAdmissionRequestDryRun(ctx))
+		req := whcontext.GetAdmissionRequest(ctx)
+		dryRun := whcontext.IsAdmissionRequestDryRun(ctx)
+
+		// the record is normally attached by admissionHandler so it can return the warnings
+		record := admissionRecordFrom(ctx)
+		if record == nil {
+			record = &admissionRecord{}
+			ctx = withAdmissionRecord(ctx, record)
+		}
+
+		namespace, err := mw.getNamespace(req.Namespace)
+		if err != nil {
+			return false, fmt.Errorf("error reading namespace %s: %s", req.Namespace, err)
+		}
+
+		start := time.Now()
+		err = mw.mutatePod(ctx, v, namespace, dryRun)
+		duration := time.Since(start)
+		mutationDuration.Observe(duration.Seconds())
+
+		event := newAuditEvent(string(req.UID), v, req.Namespace, dryRun, record, err)
+		podsTotal.WithLabelValues(req.Namespace, event.Decision).Inc()
+		mw.audit(event)
+		record.decide(event, duration)
+		for source, mode := range record.degradations() {
+			degradedAdmissionsTotal.WithLabelValues(source, string(mode)).Inc()
+		}
+
+		if !dryRun {
+			mw.events.emit(v, req.Namespace, corev1.EventTypeWarning, reasonInjectionWarning, event.Warnings)
+			if event.Decision == decisionSkipped && event.Reason != "" {
+				mw.events.emit(v, req.Namespace, corev1.EventTypeNormal, reasonInjectionSkipped, []string{event.Reason})
+			}
+		}
+
+		return false, err
 
 	default:
 		return false, nil
 	}
 }
 
-func (mw *mutatingWebhook) getDataFromConfigmap(cmName string, ns string) (map[string]string, error) {
+func (mw *mutatingWebhook) audit(event auditEvent) {
+	if mw.auditSink == nil {
+		return
+	}
+	if err := mw.auditSink.write(event); err != nil {
+		mw.logger.Errorf("error writing audit event: %s", err)
+	}
+}
+
+func (mw *mutatingWebhook) getDataFromConfigmap(ctx context.Context, cmName string, ns string) (map[string]string, error) {
+	_, span := tracer.Start(ctx, "getDataFromConfigmap", trace.WithAttributes(namespaceAttribute.String(ns), configMapAttribute.String(cmName)))
 	configMap, err := mw.k8sClient.CoreV1().ConfigMaps(ns).Get(cmName, metav1.GetOptions{})
+	endSpan(span, err)
 	if err != nil {
+		recordLookupError("configmap", err)
 		return nil, err
 	}
 	return configMap.Data, nil
 }
 
-func (mw *mutatingWebhook) getDataFromSecret(secretName string, ns string) (map[string][]byte, error) {
+func (mw *mutatingWebhook) getDataFromSecret(ctx context.Context, secretName string, ns string) (map[string][]byte, error) {
+	_, span := tracer.Start(ctx, "getDataFromSecret", trace.WithAttributes(namespaceAttribute.String(ns), secretAttribute.String(secretName)))
 	secret, err := mw.k8sClient.CoreV1().Secrets(ns).Get(secretName, metav1.GetOptions{})
+	endSpan(span, err)
 	if err != nil {
+		recordLookupError("secret", err)
 		return nil, err
 	}
 	return secret.Data, nil
 }
 
-func (mw *mutatingWebhook) lookForEnvFrom(envFrom []corev1.EnvFromSource, ns string) ([]corev1.EnvVar, error) {
-	var envVars []corev1.EnvVar
+// lookForEnvFrom adds the variables of the envFrom sources to env in order, so later sources
+// override earlier ones as they do in the kubelet
+func (mw *mutatingWebhook) lookForEnvFrom(ctx context.Context, envFrom []corev1.EnvFromSource, ns string, env *containerEnv) error {
+	record := admissionRecordFrom(ctx)
 
 	for _, ef := range envFrom {
 		if ef.ConfigMapRef != nil {
-			data, err := mw.getDataFromConfigmap(ef.ConfigMapRef.Name, ns)
+			data, err := mw.getDataFromConfigmap(ctx, ef.ConfigMapRef.Name, ns)
 			if err != nil {
-				if apierrors.IsNotFound(err) || (ef.ConfigMapRef.Optional != nil && *ef.ConfigMapRef.Optional) {
-					continue
-				} else {
-					return envVars, err
+				if !apierrors.IsNotFound(err) {
+					return &lookupError{source: lookupSourceConfigMap, err: fmt.Errorf("error reading configmap %s/%s: %s", ns, ef.ConfigMapRef.Name, err)}
 				}
-			}
-			for key, value := range data {
-				if hasSsmPrefix(value) {
-					envFromCM := corev1.EnvVar{
-						Name:  key,
-						Value: value,
-					}
-					envVars = append(envVars, envFromCM)
+				if !isOptional(ef.ConfigMapRef.Optional) {
+					record.warn("configmap %s/%s referenced by envFrom was not found, ssm references in it were not injected", ns, ef.ConfigMapRef.Name)
 				}
+				continue
+			}
+			for _, key := range sortedKeys(data) {
+				env.setFrom(ef.Prefix, key, data[key], sourceEnvFromConfigMap)
 			}
 		}
 		if ef.SecretRef != nil {
-			data, err := mw.getDataFromSecret(ef.SecretRef.Name, ns)
+			data, err := mw.getDataFromSecret(ctx, ef.SecretRef.Name, ns)
 			if err != nil {
-				if apierrors.IsNotFound(err) || (ef.SecretRef.Optional != nil && *ef.SecretRef.Optional) {
-					continue
-				} else {
-					return envVars, err
+				if !apierrors.IsNotFound(err) {
+					return &lookupError{source: lookupSourceSecret, err: fmt.Errorf("error reading secret %s/%s: %s", ns, ef.SecretRef.Name, err)}
+				}
+				if !isOptional(ef.SecretRef.Optional) {
+					record.warn("secret %s/%s referenced by envFrom was not found, ssm references in it were not injected", ns, ef.SecretRef.Name)
 				}
+				continue
 			}
+			values := make(map[string]string, len(data))
 			for key, value := range data {
-				if hasSsmPrefix(string(value)) {
-					envFromSec := corev1.EnvVar{
-						Name:  key,
-						Value: string(value),
-					}
-					envVars = append(envVars, envFromSec)
-				}
+				values[key] = string(value)
+			}
+			for _, key := range sortedKeys(values) {
+				env.setFrom(ef.Prefix, key, values[key], sourceEnvFromSecret)
 			}
 		}
 	}
-	return envVars, nil
+	return nil
 }
 
-func (mw *mutatingWebhook) lookForValueFrom(env corev1.EnvVar, ns string) (*corev1.EnvVar, error) {
-	if env.ValueFrom.ConfigMapKeyRef != nil {
-		data, err := mw.getDataFromConfigmap(env.ValueFrom.ConfigMapKeyRef.Name, ns)
+// lookForValueFrom returns the value of a ConfigMap or Secret key reference, found is false
+// when the kubelet wouldn't set the variable either
+func (mw *mutatingWebhook) lookForValueFrom(ctx context.Context, env corev1.EnvVar, ns string) (value string, found bool, err error) {
+	record := admissionRecordFrom(ctx)
+
+	if ref := env.ValueFrom.ConfigMapKeyRef; ref != nil {
+		data, err := mw.getDataFromConfigmap(ctx, ref.Name, ns)
 		if err != nil {
-			if apierrors.IsNotFound(err) {
-				return nil, nil
+			if !apierrors.IsNotFound(err) {
+				return "", false, &lookupError{source: lookupSourceConfigMap, err: fmt.Errorf("error reading configmap %s/%s: %s", ns, ref.Name, err)}
 			}
-			return nil, err
-		}
-		if hasSsmPrefix(data[env.ValueFrom.ConfigMapKeyRef.Key]) {
-			fromCM := corev1.EnvVar{
-				Name:  env.Name,
-				Value: data[env.ValueFrom.ConfigMapKeyRef.Key],
+			if !isOptional(ref.Optional) {
+				record.warn("configmap %s/%s referenced by env %s was not found, an ssm reference in it was not injected", ns, ref.Name, env.Name)
 			}
-			return &fromCM, nil
+			return "", false, nil
+		}
+		value, found := data[ref.Key]
+		if !found && !isOptional(ref.Optional) {
+			record.warn("key %s of configmap %s/%s referenced by env %s was not found, an ssm reference in it was not injected", ref.Key, ns, ref.Name, env.Name)
 		}
+		return value, found, nil
 	}
-	if env.ValueFrom.SecretKeyRef != nil {
-		data, err := mw.getDataFromSecret(env.ValueFrom.SecretKeyRef.Name, ns)
+	if ref := env.ValueFrom.SecretKeyRef; ref != nil {
+		data, err := mw.getDataFromSecret(ctx, ref.Name, ns)
 		if err != nil {
-			if apierrors.IsNotFound(err) {
-				return nil, nil
+			if !apierrors.IsNotFound(err) {
+				return "", false, &lookupError{source: lookupSourceSecret, err: fmt.Errorf("error reading secret %s/%s: %s", ns, ref.Name, err)}
 			}
-			return nil, err
-		}
-		if hasSsmPrefix(string(data[env.ValueFrom.SecretKeyRef.Key])) {
-			fromSecret := corev1.EnvVar{
-				Name:  env.Name,
-				Value: string(data[env.ValueFrom.SecretKeyRef.Key]),
+			if !isOptional(ref.Optional) {
+				record.warn("secret %s/%s referenced by env %s was not found, an ssm reference in it was not injected", ns, ref.Name, env.Name)
 			}
-			return &fromSecret, nil
+			return "", false, nil
+		}
+		value, found := data[ref.Key]
+		if !found && !isOptional(ref.Optional) {
+			record.warn("key %s of secret %s/%s referenced by env %s was not found, an ssm reference in it was not injected", ref.Key, ns, ref.Name, env.Name)
 		}
+		return string(value), found, nil
 	}
-	return nil, nil
+	return "", false, nil
 }
 
-func (mw *mutatingWebhook) mutateContainers(containers []corev1.Container, podSpec *corev1.PodSpec, ns string) (bool, error) {
-	mutated := false
+// downwardAPIValue returns the value of a field or resource reference when it is known at
+// admission, the pod name isn't when the pod has a generated one
+func downwardAPIValue(source *corev1.EnvVarSource, podName, ns string) (string, bool) {
+	if source.FieldRef == nil {
+		return "", false
+	}
+	switch source.FieldRef.FieldPath {
+	case "metadata.namespace":
+		return ns, true
+	case "metadata.name":
+		return podName, podName != ""
+	}
+	return "", false
+}
 
-	for i, container := range containers {
-		var envVars []corev1.EnvVar
-		if len(container.EnvFrom) > 0 {
-			envFrom, err := mw.lookForEnvFrom(container.EnvFrom, ns)
-			if err != nil {
-				return false, err
+// lookForContainerEnv resolves the environment of the container the way the kubelet does. The
+// variables of the secrets annotation are added ahead of env, so they override envFrom and are
+// overridden by env. Like the kubelet, the values of both are expanded against the variables
+// set before them, values from envFrom and valueFrom are not. Field and resource references
+// the kubelet resolves are unknown here, references to them are kept unexpanded
+func (mw *mutatingWebhook) lookForContainerEnv(ctx context.Context, container *corev1.Container, manifestVars []corev1.EnvVar, prefix referencePrefix, ns, podName string) (*containerEnv, error) {
+	env := newContainerEnv(admissionRecordFrom(ctx), prefix)
+	if err := mw.lookForEnvFrom(ctx, container.EnvFrom, ns, env); err != nil {
+		return nil, err
+	}
+
+	for _, envVar := range manifestVars {
+		env.set(envVar.Name, env.expand(envVar.Value), sourceManifest)
+	}
+
+	for _, envVar := range container.Env {
+		if envVar.ValueFrom == nil {
+			env.set(envVar.Name, env.expand(envVar.Value), sourceEnv)
+			continue
+		}
+		if envVar.ValueFrom.FieldRef != nil || envVar.ValueFrom.ResourceFieldRef != nil {
+			if value, known := downwardAPIValue(envVar.ValueFrom, podName, ns); known {
+				env.set(envVar.Name, value, sourceValueFrom)
+			} else {
+				env.setUnknown(envVar.Name, sourceValueFrom)
 			}
-			envVars = append(envVars, envFrom...)
+			continue
+		}
+		value, found, err := mw.lookForValueFrom(ctx, envVar, ns)
+		if err != nil {
+			return nil, err
 		}
+		if found {
+			env.set(envVar.Name, value, sourceValueFrom)
+		}
+	}
+	return env, nil
+}
 
-		for _, env := range container.Env {
-			if hasSsmPrefix(env.Value) {
-				envVars = append(envVars, env)
-			}
-			if env.ValueFrom != nil {
-				valueFrom, err := mw.lookForValueFrom(env, ns)
-				if err != nil {
-					return false, err
-				}
-				if valueFrom == nil {
-					continue
-				}
-				envVars = append(envVars, *valueFrom)
+func (mw *mutatingWebhook) mutateContainers(ctx context.Context, containers []corev1.Container, podSpec *corev1.PodSpec, settings *webhookSettings, config ssmConfig, ns, podName string) (mutated bool, err error) {
+	ctx, span := tracer.Start(ctx, "mutateContainers", trace.WithAttributes(namespaceAttribute.String(ns)))
+	defer func() { endSpan(span, err) }()
+
+	record := admissionRecordFrom(ctx)
+	pathPrefix := settings.pathPrefix(ns, podServiceAccount(podSpec))
+	prefix := settings.referencePrefix()
+
+	for i, container := range containers {
+		// the webhook is invoked again when another webhook changed the pod
+		if wrappedBySsmEnv(&container, prefix) {
+			continue
+		}
+		manifestVars := manifestEnv(config.Secrets, prefix, container.Name, isInitContainer(podSpec, container.Name))
+		env, err := mw.lookForContainerEnv(ctx, &container, manifestVars, prefix, ns, podName)
+		if err != nil {
+			if err := admitPartially(record, settings, container.Name, err); err != nil {
+				return false, err
 			}
+			continue
 		}
-
-		if len(envVars) == 0 {
+		envVars := env.references()
+		// escaped values are unescaped by ssm-env, so containers holding them are mutated as well
+		if len(envVars) == 0 && !env.hasEscapes() && !prefix.rewritesArgs(container.Command) && !prefix.rewritesArgs(container.Args) {
 			continue
 		}
-
-		mutated = true
+		if settings.PolicyError != "" {
+			return false, fmt.Errorf("%s", settings.PolicyError)
+		}
 
 		args := container.Command
 
 		// the container has no explicitly specified command
 		if len(args) == 0 {
-			imageConfig, err := mw.registry.GetImageConfig(mw.k8sClient, ns, &container, podSpec)
+			imageConfig, err := mw.getImageConfig(ctx, &container, podSpec, settings, config, ns)
 			if err != nil {
-				return false, err
+				if settings.StrictEntrypointResolution {
+					return false, entrypointNotDeterminedError(&container, err)
+				}
+				// only failures of the registry itself fall under its failure mode
+				var unavailable *registryUnavailableError
+				if !errors.As(err, &unavailable) {
+					return false, err
+				}
+				if err := admitPartially(record, settings, container.Name, &lookupError{source: lookupSourceRegistry, err: err}); err != nil {
+					return false, err
+				}
+				continue
 			}
 
 			args = append(args, imageConfig.Entrypoint...)
@@ -261,31 +453,152 @@ func (mw *mutatingWebhook) mutateContainers(containers []corev1.Container, podSp
 
 		args = append(args, container.Args...)
 
-		container.Command = []string{"/mutate/ssm-env"}
+		if len(args) == 0 && settings.StrictEntrypointResolution {
+			return false, entrypointNotDeterminedError(&container, nil)
+		}
+
+		container.Command = []string{prefix.ssmEnvPath()}
 		container.Args = args
+		container.Env = append(manifestVars, container.Env...)
 
 		container.VolumeMounts = append(container.VolumeMounts, []corev1.VolumeMount{
 			{
-				Name:      "ssm-env",
-				MountPath: "/mutate/",
+				Name:      prefix.volumeName(),
+				MountPath: prefix.mutateDir(),
 			},
 		}...)
 
 		container.Env = append(container.Env, []corev1.EnvVar{
 			{
-				Name:  "SSM_IGNORE_MISSING_SECRETS",
-				Value: viper.GetString("ssm_ignore_missing_secrets"),
+				Name:  prefix.envName("SSM_IGNORE_MISSING_SECRETS"),
+				Value: strconv.FormatBool(settings.IgnoreMissingSecrets),
 			},
 			{
-				Name:  "SSM_JSON_LOG",
-				Value: viper.GetString("enable_json_log"),
+				Name:  prefix.envName("SSM_JSON_LOG"),
+				Value: strconv.FormatBool(settings.JSONLog),
 			},
 			{
-				Name:  "SSM_AWS_REGION",
-				Value: mw.region,
+				Name:  prefix.envName("SSM_AWS_REGION"),
+				Value: settings.Region,
 			},
 		}...)
 
+		if templates := argTemplates(args, envVars); len(templates) > 0 {
+			data, err := json.Marshal(expandArgsManifest{Args: templates, Variables: env.templateVariables(templates)})
+			if err != nil {
+				return false, fmt.Errorf("error encoding SSM_EXPAND_ARGS: %s", err)
+			}
+			container.Env = append(container.Env, corev1.EnvVar{Name: prefix.envName("SSM_EXPAND_ARGS"), Value: escapeExpansion(string(data))})
+		}
+		if settings.WrapExecHandlers && wrapExecHandlers(&container, prefix) && settings.ExecHandlerCacheTTL > 0 {
+			container.Env = append(container.Env, []corev1.EnvVar{
+				{
+					Name:  prefix.envName("SSM_CACHE_DIR"),
+					Value: prefix.mutateDir() + secretCacheDir + container.Name,
+				},
+				{
+					Name:  prefix.envName("SSM_CACHE_TTL"),
+					Value: settings.ExecHandlerCacheTTL.String(),
+				},
+			}...)
+		}
+		if settings.RoleARN != "" {
+			container.Env = append(container.Env, corev1.EnvVar{Name: prefix.envName("SSM_ROLE_ARN"), Value: settings.RoleARN})
+		}
+		// ssm-env checks the paths it resolves as well, they can change after admission through
+		// ConfigMaps and kubelet expansion
+		if len(settings.AllowedPathPrefixes) > 0 {
+			data, err := json.Marshal(settings.AllowedPathPrefixes)
+			if err != nil {
+				return false, fmt.Errorf("error encoding SSM_ALLOWED_PREFIXES: %s", err)
+			}
+			container.Env = append(container.Env, corev1.EnvVar{Name: prefix.envName("SSM_ALLOWED_PREFIXES"), Value: escapeExpansion(string(data))})
+		}
+		if prefix != defaultReferencePrefix {
+			container.Env = append(container.Env, corev1.EnvVar{Name: prefix.envName("SSM_REFERENCE_PREFIX"), Value: string(prefix)})
+		}
+
+		options := map[string]variableOptions{}
+		fileModeVariables := false
+		for _, envVar := range manifestVars {
+			entry := config.Secrets[envVar.Name]
+			if env.source(envVar.Name) != sourceManifest {
+				continue
+			}
+			if entry.FileMode != nil && !*entry.FileMode && settings.FileModeForcedBy != "" {
+				record.warn("the fileMode: false option of %s in the %s annotation is ignored, SsmInjectionPolicy %s forces file mode", envVar.Name, prefix.annotation(secretsAnnotation), settings.FileModeForcedBy)
+				entry.FileMode = nil
+			}
+			if !entry.Optional && entry.FileMode == nil {
+				continue
+			}
+			options[envVar.Name] = variableOptions{Optional: entry.Optional, FileMode: entry.FileMode}
+			fileModeVariables = fileModeVariables || (entry.FileMode != nil && *entry.FileMode)
+		}
+		if len(options) > 0 {
+			data, err := json.Marshal(options)
+			if err != nil {
+				return false, fmt.Errorf("error encoding SSM_VARIABLE_OPTIONS: %s", err)
+			}
+			container.Env = append(container.Env, corev1.EnvVar{Name: prefix.envName("SSM_VARIABLE_OPTIONS"), Value: escapeExpansion(string(data))})
+		}
+
+		if settings.FileMode {
+			container.Env = append(container.Env, corev1.EnvVar{Name: prefix.envName("SSM_FILE_DIR"), Value: prefix.mutateDir() + secretFileDir + container.Name})
+		} else if fileModeVariables {
+			// only the variables with the fileMode option are written to files
+			container.Env = append(container.Env, []corev1.EnvVar{
+				{
+					Name:  prefix.envName("SSM_FILE_DIR"),
+					Value: prefix.mutateDir() + secretFileDir + container.Name,
+				},
+				{
+					Name:  prefix.envName("SSM_FILE_MODE"),
+					Value: "false",
+				},
+			}...)
+		}
+
+		references := make([]ssmReference, 0, len(envVars))
+		relativePaths := false
+		addReference := func(reference ssmReference, description string) error {
+			var relative bool
+			reference.Path, relative = resolvePath(pathPrefix, reference.Path)
+			relativePaths = relativePaths || relative
+			if reason := malformedReference(reference.Path); reason != "" {
+				record.warn("%s of container %s looks like a malformed ssm reference, %s", description, container.Name, reason)
+			}
+			// variables are expanded by ssm-env, only the part before them is known here
+			if !settings.pathAllowed(literalPath(reference.Path)) {
+				return fmt.Errorf("parameter %s referenced by %s of container %s is not allowed by SsmInjectionPolicy %s", reference.Path, description, container.Name, strings.Join(settings.Policies, ", "))
+			}
+			references = append(references, reference)
+			return nil
+		}
+		for _, env := range envVars {
+			if err := addReference(newSsmReference(prefix, env.Name, env.Value), "env "+env.Name); err != nil {
+				return false, err
+			}
+		}
+		// ssm-env receives the original command as its arguments
+		for j, arg := range args {
+			path, ok := prefix.argReference(arg)
+			if !ok {
+				continue
+			}
+			referencesFoundTotal.WithLabelValues(sourceArgs).Inc()
+			if err := addReference(ssmReference{Name: fmt.Sprintf("args[%d]", j), Path: path}, fmt.Sprintf("argument %d", j)); err != nil {
+				return false, err
+			}
+		}
+		if relativePaths {
+			container.Env = append(container.Env, corev1.EnvVar{Name: prefix.envName("SSM_PATH_PREFIX"), Value: pathPrefix})
+		}
+		container.Env = append(container.Env, pathVariableEnv(record, container.Name, env, references)...)
+		record.addContainer(container.Name, references)
+		mutated = true
+		containersWrappedTotal.WithLabelValues(ns).Inc()
+
 		containers[i] = container
 	}
 
@@ -301,6 +614,15 @@ func newK8SClient() (kubernetes.Interface, error) {
 	return kubernetes.NewForConfig(kubeConfig)
 }
 
+func newDynamicClient() (dynamic.Interface, error) {
+	kubeConfig, err := kubernetesConfig.GetConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	return dynamic.NewForConfig(kubeConfig)
+}
+
 func healthzHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(200)
 }
@@ -314,17 +636,30 @@ func handlerFor(config mutating.WebhookConfig, mutator mutating.MutatorFunc, rec
 	return whhttp.MustHandlerFor(webhook)
 }
 
-func (mw *mutatingWebhook) serveMetrics(addr string) {
-	mw.logger.Infof("Telemetry on http://%s", addr)
+func (mw *mutatingWebhook) serveMetrics(server *http.Server) {
+	mw.logger.Infof("Telemetry on %s://%s", scheme(server), server.Addr)
 
-	mux := http.NewServeMux()
-	mux.Handle("/metrics", promhttp.Handler())
-	err := http.ListenAndServe(addr, mux)
-	if err != nil {
+	err := listenAndServe(server)
+	if err != nil && err != http.ErrServerClosed {
 		mw.logger.Fatalf("error serving telemetry: %s", err)
 	}
 }
 
+func (mw *mutatingWebhook) telemetryHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", requireClientCert(promhttp.Handler(), mw.logger))
+
+	if mw.history != nil {
+		mux.Handle("/debug/mutations", requireClientCert(mw.history, mw.logger))
+	}
+
+	if viper.GetBool("enable_pprof") {
+		registerPprof(mux, mw.logger)
+	}
+
+	return mux
+}
+
 func main() {
 	var logger logrus.FieldLogger
 	{
@@ -342,6 +677,21 @@ func main() {
 		logger = log.WithField("app", "ssm-secrets-webhook")
 	}
 
+	logger.Infof("ssm-secrets-webhook version %s", version)
+
+	known := knownSettings()
+	configFile := viper.GetString("config_file")
+	if configFile != "" {
+		if err := readConfigFile(configFile, known); err != nil {
+			logger.Fatalf("error loading config file: %s", err)
+		}
+	}
+
+	shutdownTracing, err := initTracing(context.Background())
+	if err != nil {
+		logger.Fatalf("error initializing tracing: %s", err)
+	}
+
 	k8sClient, err := newK8SClient()
 	if err != nil {
 		logger.Fatalf("error creating k8s client: %s", err)
@@ -352,44 +702,149 @@ func main() {
 		logger.Fatalf("error determining aws region: %s", err)
 	}
 
-	mutatingWebhook := mutatingWebhook{
+	settings, err := newWebhookSettings(viper.GetViper(), awsRegion)
+	if err != nil {
+		logger.Fatalf("invalid configuration: %s", err)
+	}
+
+	imageRegistry, err := newPlatformRegistry(viper.GetString("default_image_platform"), logger)
+	if err != nil {
+		logger.Fatalf("error creating image registry: %s", err)
+	}
+
+	auditSink, err := newAuditSink(logger)
+	if err != nil {
+		logger.Fatalf("error creating audit sink: %s", err)
+	}
+
+	mutatingWebhook := &mutatingWebhook{
 		k8sClient: k8sClient,
-		registry:  registry.NewRegistry(),
+		registry:  imageRegistry,
 		logger:    logger,
-		region:    awsRegion,
+		auditSink: auditSink,
+		events:    newEventEmitter(k8sClient, logger),
+		history:   newMutationHistory(viper.GetInt("debug_mutations_history_size")),
+	}
+	mutatingWebhook.settings.Store(settings)
+
+	namespaces, namespacesCheck, err := newNamespaceLister(k8sClient, viper.GetDuration("informer_resync_period"), viper.GetDuration("informer_sync_timeout"), make(chan struct{}))
+	if err != nil {
+		logger.Fatalf("error starting namespace informer: %s", err)
+	}
+	mutatingWebhook.namespaces = namespaces
+
+	var policiesCheck readinessCheck
+	if viper.GetBool("enable_injection_policies") {
+		dynamicClient, err := newDynamicClient()
+		if err != nil {
+			logger.Fatalf("error creating dynamic k8s client: %s", err)
+		}
+		policies := newPolicyStore(dynamicClient, logger)
+		policiesCheck, err = policies.start(viper.GetDuration("informer_resync_period"), viper.GetDuration("informer_sync_timeout"), make(chan struct{}))
+		if err != nil {
+			logger.Fatalf("error starting SsmInjectionPolicy informer: %s", err)
+		}
+		mutatingWebhook.policies = policies
+	}
+
+	if configFile != "" {
+		watcher := newConfigWatcher(configFile, known, awsRegion, func(settings *webhookSettings) { mutatingWebhook.settings.Store(settings) }, logger)
+		if err := watcher.watch(); err != nil {
+			logger.Fatalf("error watching config file: %s", err)
+		}
 	}
 
 	mutator := mutating.MutatorFunc(mutatingWebhook.ssmSecretsMutator)
 
 	metricsRecorder := metrics.NewPrometheus(prometheus.DefaultRegisterer)
+	registerMetrics(prometheus.DefaultRegisterer)
 
 	podHandler := handlerFor(mutating.WebhookConfig{Name: "ssm-secrets-pods", Obj: &corev1.Pod{}}, mutator, metricsRecorder, logger)
 
-	mux := http.NewServeMux()
-	mux.Handle("/pods", podHandler)
-	mux.Handle("/healthz", http.HandlerFunc(healthzHandler))
-
 	telemetryAddress := viper.GetString("telemetry_listen_address")
 	listenAddress := viper.GetString("listen_address")
 	tlsCertFile := viper.GetString("tls_cert_file")
 	tlsPrivateKeyFile := viper.GetString("tls_private_key_file")
 
-	if len(telemetryAddress) > 0 {
-		// Serving metrics without TLS on separated address
-		go mutatingWebhook.serveMetrics(telemetryAddress)
-	} else {
-		mux.Handle("/metrics", promhttp.Handler())
+	var keypair *keypairReloader
+	if viper.GetBool("tls_auto_generate") {
+		var bootstrapper *tlsBootstrapper
+		bootstrapper, err = newTLSBootstrapper(k8sClient, logger)
+		if err != nil {
+			logger.Fatalf("error configuring tls bootstrap: %s", err)
+		}
+
+		keypair = &keypairReloader{logger: logger}
+		if err = bootstrapper.bootstrap(keypair); err != nil {
+			logger.Fatalf("error bootstrapping tls certificate: %s", err)
+		}
+		go bootstrapper.run(keypair, viper.GetDuration("tls_refresh_interval"))
+	} else if tlsCertFile != "" || tlsPrivateKeyFile != "" {
+		keypair, err = newKeypairReloader(tlsCertFile, tlsPrivateKeyFile, logger)
+		if err != nil {
+			logger.Fatalf("error loading tls certificate: %s", err)
+		}
+		go keypair.watch()
 	}
 
-	if tlsCertFile == "" && tlsPrivateKeyFile == "" {
-		logger.Infof("Listening on http://%s", listenAddress)
-		err = http.ListenAndServe(listenAddress, mux)
+	var tlsConfig *tls.Config
+	if keypair != nil {
+		tlsConfig, err = newTLSConfig(keypair)
+		if err != nil {
+			logger.Fatalf("error configuring tls: %s", err)
+		}
+	} else if viper.GetBool("tls_verify_client_cert") {
+		logger.Fatal("tls_verify_client_cert requires a serving certificate")
+	}
+
+	readiness := newReadinessChecker(viper.GetDuration("readiness_check_timeout"))
+	readiness.add("kubernetes", kubernetesCheck(k8sClient))
+	readiness.add("namespaces", namespacesCheck)
+	if policiesCheck != nil {
+		readiness.add("policies", policiesCheck)
+	}
+	if keypair != nil {
+		readiness.add("tls", tlsCheck(keypair))
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/pods", requireClientCert(traceHandler("/pods", admissionHandler(podHandler, mutatingWebhook.history)), logger))
+	mux.Handle("/healthz", http.HandlerFunc(healthzHandler))
+	mux.Handle("/readyz", readiness)
+
+	server := newServer(listenAddress, mux, tlsConfig)
+	servers := []*http.Server{server}
+
+	if len(telemetryAddress) > 0 {
+		// Serving metrics on separated address, without TLS unless client certificates are verified
+		var telemetryTLSConfig *tls.Config
+		if viper.GetBool("tls_verify_client_cert") {
+			telemetryTLSConfig = tlsConfig
+		}
+		telemetryServer := newServer(telemetryAddress, mutatingWebhook.telemetryHandler(), telemetryTLSConfig)
+		servers = append(servers, telemetryServer)
+		go mutatingWebhook.serveMetrics(telemetryServer)
 	} else {
-		logger.Infof("Listening on https://%s", listenAddress)
-		err = http.ListenAndServeTLS(listenAddress, tlsCertFile, tlsPrivateKeyFile, mux)
+		mux.Handle("/metrics", requireClientCert(promhttp.Handler(), logger))
+		if viper.GetBool("enable_pprof") {
+			logger.Warn("pprof is only served on the telemetry listener, set telemetry_listen_address to enable it")
+		}
+		if mutatingWebhook.history != nil {
+			logger.Debug("/debug/mutations is only served on the telemetry listener")
+		}
 	}
 
-	if err != nil {
-		logger.Fatalf("error serving webhook: %s", err)
+	go func() {
+		logger.Infof("Listening on %s://%s", scheme(server), listenAddress)
+		err := listenAndServe(server)
+		if err != nil && err != http.ErrServerClosed {
+			logger.Fatalf("error serving webhook: %s", err)
+		}
+	}()
+
+	shutdownOnSignal(logger, readiness, servers...)
+
+	if err := shutdownTracing(context.Background()); err != nil {
+		logger.Errorf("error flushing traces: %s", err)
 	}
 }
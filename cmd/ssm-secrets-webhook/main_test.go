@@ -19,6 +19,8 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"testing"
 
 	"github.com/banzaicloud/bank-vaults/cmd/vault-secrets-webhook/registry"
@@ -32,26 +34,33 @@ import (
 
 type MockRegistry struct {
 	Image imagev1.ImageConfig
+	Err   error
 }
 
 func (r *MockRegistry) GetImageConfig(_ kubernetes.Interface, _ string, _ *corev1.Container, _ *corev1.PodSpec) (*imagev1.ImageConfig, error) {
+	if r.Err != nil {
+		return nil, r.Err
+	}
 	return &r.Image, nil
 }
 
 func Test_mutatingWebhook_mutateContainers(t *testing.T) {
 	type fields struct {
-		k8sClient kubernetes.Interface
-		registry  registry.ImageRegistry
+		k8sClient        kubernetes.Interface
+		registry         registry.ImageRegistry
+		imageEntrypoints []imageEntrypointMapping
 	}
 	type args struct {
 		containers []corev1.Container
 		podSpec    *corev1.PodSpec
+		config     ssmConfig
 		ns         string
 	}
 	tests := []struct {
 		name             string
 		fields           fields
 		args             args
+		strict           bool
 		mutated          bool
 		wantErr          bool
 		wantedContainers []corev1.Container
@@ -96,6 +105,9 @@ func Test_mutatingWebhook_mutateContainers(t *testing.T) {
 							Name:  "SSM_JSON_LOG",
 							Value: "false",
 						},
+						{
+							Name: "SSM_AWS_REGION",
+						},
 					},
 				},
 			},
@@ -144,6 +156,9 @@ func Test_mutatingWebhook_mutateContainers(t *testing.T) {
 							Name:  "SSM_JSON_LOG",
 							Value: "false",
 						},
+						{
+							Name: "SSM_AWS_REGION",
+						},
 					},
 				},
 			},
@@ -192,6 +207,187 @@ func Test_mutatingWebhook_mutateContainers(t *testing.T) {
 							Name:  "SSM_JSON_LOG",
 							Value: "false",
 						},
+						{
+							Name: "SSM_AWS_REGION",
+						},
+					},
+				},
+			},
+			mutated: true,
+			wantErr: false,
+		},
+		{name: "Will use entrypoint from pod annotation before the registry",
+			fields: fields{
+				k8sClient: fake.NewSimpleClientset(),
+				registry: &MockRegistry{
+					Err: errors.New("registry unreachable"),
+				},
+			},
+			args: args{
+				containers: []corev1.Container{
+					{
+						Name:  "MyContainer",
+						Image: "myimage",
+						Args:  []string{"--flag"},
+						Env: []corev1.EnvVar{
+							{Name: "myvar", Value: "ssm:secrets"},
+						},
+					},
+				},
+				config: ssmConfig{
+					Entrypoints: map[string]imageEntrypoint{
+						"MyContainer": {Entrypoint: []string{"/app"}, Cmd: []string{"serve"}},
+					},
+				},
+			},
+			wantedContainers: []corev1.Container{
+				{
+					Name:         "MyContainer",
+					Image:        "myimage",
+					Command:      []string{"/mutate/ssm-env"},
+					Args:         []string{"/app", "--flag"},
+					VolumeMounts: []corev1.VolumeMount{{Name: "ssm-env", MountPath: "/mutate/"}},
+					Env: []corev1.EnvVar{
+						{
+							Name:  "myvar",
+							Value: "ssm:secrets",
+						},
+						{
+							Name:  "SSM_IGNORE_MISSING_SECRETS",
+							Value: "false",
+						},
+						{
+							Name:  "SSM_JSON_LOG",
+							Value: "false",
+						},
+						{
+							Name: "SSM_AWS_REGION",
+						},
+					},
+				},
+			},
+			mutated: true,
+			wantErr: false,
+		},
+		{name: "Will use entrypoint from image entrypoint mapping before the registry",
+			fields: fields{
+				k8sClient: fake.NewSimpleClientset(),
+				registry: &MockRegistry{
+					Err: errors.New("registry unreachable"),
+				},
+				imageEntrypoints: []imageEntrypointMapping{
+					{Image: "other/*", Entrypoint: []string{"/other"}},
+					{Image: "registry.local/team/*", Entrypoint: []string{"/app"}, Cmd: []string{"serve"}},
+				},
+			},
+			args: args{
+				containers: []corev1.Container{
+					{
+						Name:  "MyContainer",
+						Image: "registry.local/team/myimage:1.0",
+						Env: []corev1.EnvVar{
+							{Name: "myvar", Value: "ssm:secrets"},
+						},
+					},
+				},
+			},
+			wantedContainers: []corev1.Container{
+				{
+					Name:         "MyContainer",
+					Image:        "registry.local/team/myimage:1.0",
+					Command:      []string{"/mutate/ssm-env"},
+					Args:         []string{"/app", "serve"},
+					VolumeMounts: []corev1.VolumeMount{{Name: "ssm-env", MountPath: "/mutate/"}},
+					Env: []corev1.EnvVar{
+						{
+							Name:  "myvar",
+							Value: "ssm:secrets",
+						},
+						{
+							Name:  "SSM_IGNORE_MISSING_SECRETS",
+							Value: "false",
+						},
+						{
+							Name:  "SSM_JSON_LOG",
+							Value: "false",
+						},
+						{
+							Name: "SSM_AWS_REGION",
+						},
+					},
+				},
+			},
+			mutated: true,
+			wantErr: false,
+		},
+		{name: "Will deny container without a determinable command in strict mode",
+			fields: fields{
+				k8sClient: fake.NewSimpleClientset(),
+				registry: &MockRegistry{
+					Image: imagev1.ImageConfig{},
+				},
+			},
+			args: args{
+				containers: []corev1.Container{
+					{
+						Name:  "MyContainer",
+						Image: "myimage",
+						Env: []corev1.EnvVar{
+							{Name: "myvar", Value: "ssm:secrets"},
+						},
+					},
+				},
+			},
+			wantedContainers: []corev1.Container{
+				{
+					Name:  "MyContainer",
+					Image: "myimage",
+					Env: []corev1.EnvVar{
+						{Name: "myvar", Value: "ssm:secrets"},
+					},
+				},
+			},
+			strict:  true,
+			mutated: false,
+			wantErr: true,
+		},
+		{name: "Will mutate container with references in args only",
+			fields: fields{
+				k8sClient: fake.NewSimpleClientset(),
+				registry: &MockRegistry{
+					Image: imagev1.ImageConfig{
+						Entrypoint: []string{"/bin/db"},
+					},
+				},
+			},
+			args: args{
+				containers: []corev1.Container{
+					{
+						Name:  "MyContainer",
+						Image: "myimage",
+						Args:  []string{"--user=admin", "--password=ssm:/db/pass", "ssm:/db/host"},
+					},
+				},
+			},
+			wantedContainers: []corev1.Container{
+				{
+					Name:         "MyContainer",
+					Image:        "myimage",
+					Command:      []string{"/mutate/ssm-env"},
+					Args:         []string{"/bin/db", "--user=admin", "--password=ssm:/db/pass", "ssm:/db/host"},
+					VolumeMounts: []corev1.VolumeMount{{Name: "ssm-env", MountPath: "/mutate/"}},
+					Env: []corev1.EnvVar{
+						{
+							Name:  "SSM_IGNORE_MISSING_SECRETS",
+							Value: "false",
+						},
+						{
+							Name:  "SSM_JSON_LOG",
+							Value: "false",
+						},
+						{
+							Name: "SSM_AWS_REGION",
+						},
 					},
 				},
 			},
@@ -233,7 +429,11 @@ func Test_mutatingWebhook_mutateContainers(t *testing.T) {
 				registry:  tt.fields.registry,
 				logger:    logrus.New(),
 			}
-			got, err := mw.mutateContainers(tt.args.containers, tt.args.podSpec, tt.args.ns)
+			settings := &webhookSettings{
+				StrictEntrypointResolution: tt.strict,
+				ImageEntrypoints:           tt.fields.imageEntrypoints,
+			}
+			got, err := mw.mutateContainers(context.Background(), tt.args.containers, tt.args.podSpec, settings, tt.args.config, tt.args.ns, "")
 			if (err != nil) != tt.wantErr {
 				t.Errorf("mutatingWebhook.mutateContainers() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -0,0 +1,132 @@
+// Copyright © 2020 Peter Wilson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/yaml"
+)
+
+// secretManifestEntry is a variable of the secrets annotation, written either as the parameter
+// path alone or as an object with options
+type secretManifestEntry struct {
+	Path string `json:"path"`
+	// Containers the variable is injected into, all containers but init containers when empty
+	Containers []string `json:"containers,omitempty"`
+	// Optional variables are left out when the parameter can't be read
+	Optional bool `json:"optional,omitempty"`
+	// FileMode overrides the file mode setting for the variable
+	FileMode *bool `json:"fileMode,omitempty"`
+}
+
+func (e *secretManifestEntry) UnmarshalJSON(data []byte) error {
+	var path string
+	if err := json.Unmarshal(data, &path); err == nil {
+		e.Path = path
+		return nil
+	}
+	type entry secretManifestEntry
+	return json.Unmarshal(data, (*entry)(e))
+}
+
+// variableOptions are the options of a variable passed to ssm-env in SSM_VARIABLE_OPTIONS
+type variableOptions struct {
+	Optional bool  `json:"optional,omitempty"`
+	FileMode *bool `json:"fileMode,omitempty"`
+}
+
+// parseSecretManifest parses the YAML or JSON secrets annotation of variable name to entry
+func parseSecretManifest(value string) (map[string]secretManifestEntry, error) {
+	manifest := map[string]secretManifestEntry{}
+	if err := yaml.Unmarshal([]byte(value), &manifest); err != nil {
+		return nil, err
+	}
+	for name, entry := range manifest {
+		if errs := validation.IsEnvVarName(name); len(errs) > 0 {
+			return nil, fmt.Errorf("%s is not a valid environment variable name: %s", name, strings.Join(errs, ", "))
+		}
+		entry.Path = strings.TrimPrefix(entry.Path, string(defaultReferencePrefix))
+		if entry.Path == "" {
+			return nil, fmt.Errorf("variable %s has no parameter path", name)
+		}
+		manifest[name] = entry
+	}
+	return manifest, nil
+}
+
+// manifestEnv returns the variables of the manifest targeting the container, in name order
+func manifestEnv(manifest map[string]secretManifestEntry, prefix referencePrefix, container string, initContainer bool) []corev1.EnvVar {
+	var envVars []corev1.EnvVar
+	for name, entry := range manifest {
+		if !entry.targets(container, initContainer) {
+			continue
+		}
+		envVars = append(envVars, corev1.EnvVar{Name: name, Value: string(prefix) + prefix.path(entry.Path)})
+	}
+	sort.Slice(envVars, func(i, j int) bool { return envVars[i].Name < envVars[j].Name })
+	return envVars
+}
+
+func (e secretManifestEntry) targets(container string, initContainer bool) bool {
+	if len(e.Containers) == 0 {
+		return !initContainer
+	}
+	for _, name := range e.Containers {
+		if name == container {
+			return true
+		}
+	}
+	return false
+}
+
+// unknownManifestContainers returns the containers targeted by the manifest that aren't in the pod
+func unknownManifestContainers(manifest map[string]secretManifestEntry, podSpec *corev1.PodSpec) []string {
+	known := map[string]bool{}
+	for _, container := range append(append([]corev1.Container(nil), podSpec.InitContainers...), podSpec.Containers...) {
+		known[container.Name] = true
+	}
+	unknown := map[string]bool{}
+	for _, entry := range manifest {
+		for _, name := range entry.Containers {
+			if !known[name] {
+				unknown[name] = true
+			}
+		}
+	}
+	names := make([]string, 0, len(unknown))
+	for name := range unknown {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func isInitContainer(podSpec *corev1.PodSpec, name string) bool {
+	if podSpec == nil {
+		return false
+	}
+	for _, container := range podSpec.InitContainers {
+		if container.Name == name {
+			return true
+		}
+	}
+	return false
+}
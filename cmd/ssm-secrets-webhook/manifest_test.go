@@ -0,0 +1,152 @@
+// Copyright © 2020 Peter Wilson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	cmp "github.com/google/go-cmp/cmp"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	fake "k8s.io/client-go/kubernetes/fake"
+)
+
+func Test_parseSecretManifest(t *testing.T) {
+	fileMode := true
+
+	tests := []struct {
+		name    string
+		value   string
+		want    map[string]secretManifestEntry
+		wantErr bool
+	}{
+		{
+			name: "yaml",
+			value: `
+DB_PASSWORD: /db/pass
+API_KEY:
+  path: ssm:/api/key
+  containers: [app]
+  optional: true
+  fileMode: true
+`,
+			want: map[string]secretManifestEntry{
+				"DB_PASSWORD": {Path: "/db/pass"},
+				"API_KEY":     {Path: "/api/key", Containers: []string{"app"}, Optional: true, FileMode: &fileMode},
+			},
+		},
+		{
+			name:  "json",
+			value: `{"DB_PASSWORD": "/db/pass", "API_KEY": {"path": "/api/key"}}`,
+			want: map[string]secretManifestEntry{
+				"DB_PASSWORD": {Path: "/db/pass"},
+				"API_KEY":     {Path: "/api/key"},
+			},
+		},
+		{
+			name:    "invalid variable name",
+			value:   `1DB_PASSWORD: /db/pass`,
+			wantErr: true,
+		},
+		{
+			name:    "no path",
+			value:   `DB_PASSWORD: {optional: true}`,
+			wantErr: true,
+		},
+		{
+			name:    "not an object",
+			value:   `[/db/pass]`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseSecretManifest(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseSecretManifest() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !cmp.Equal(got, tt.want) {
+				t.Errorf("parseSecretManifest() diff %v", cmp.Diff(got, tt.want))
+			}
+		})
+	}
+}
+
+func Test_mutatingWebhook_mutateContainers_secretManifest(t *testing.T) {
+	manifest, err := parseSecretManifest(`
+DB_PASSWORD: /db/pass
+USER: /db/user
+API_KEY: {path: /api/key, containers: [app, migrate], optional: true, fileMode: true}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mw := &mutatingWebhook{
+		k8sClient: fake.NewSimpleClientset(&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+			Data:       map[string]string{"DB_PASSWORD": "plain", "API_KEY": "plain"},
+		}),
+		logger: logrus.New(),
+	}
+	podSpec := &corev1.PodSpec{
+		InitContainers: []corev1.Container{{Name: "migrate", Command: []string{"/migrate"}}},
+		Containers: []corev1.Container{
+			{
+				Name:    "app",
+				Command: []string{"/app"},
+				EnvFrom: []corev1.EnvFromSource{{ConfigMapRef: &corev1.ConfigMapEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "app"}}}},
+				Env:     []corev1.EnvVar{{Name: "USER", Value: "admin"}},
+			},
+			{Name: "sidecar", Command: []string{"/sidecar"}},
+		},
+	}
+
+	record := &admissionRecord{}
+	ctx := withAdmissionRecord(context.Background(), record)
+	for _, containers := range [][]corev1.Container{podSpec.InitContainers, podSpec.Containers} {
+		if _, err := mw.mutateContainers(ctx, containers, podSpec, &webhookSettings{}, ssmConfig{Secrets: manifest}, "default", ""); err != nil {
+			t.Fatalf("mutatingWebhook.mutateContainers() error = %v", err)
+		}
+	}
+
+	want := []containerRecord{
+		{Name: "migrate", References: []ssmReference{{Name: "API_KEY", Path: "/api/key"}}},
+		{Name: "app", References: []ssmReference{{Name: "API_KEY", Path: "/api/key"}, {Name: "DB_PASSWORD", Path: "/db/pass"}}},
+		{Name: "sidecar", References: []ssmReference{{Name: "DB_PASSWORD", Path: "/db/pass"}, {Name: "USER", Path: "/db/user"}}},
+	}
+	if got := record.mutatedContainers(); !cmp.Equal(got, want) {
+		t.Errorf("mutatingWebhook.mutateContainers() diff %v", cmp.Diff(got, want))
+	}
+
+	wantEnv := []corev1.EnvVar{
+		{Name: "API_KEY", Value: "ssm:/api/key"},
+		{Name: "DB_PASSWORD", Value: "ssm:/db/pass"},
+		{Name: "USER", Value: "ssm:/db/user"},
+		{Name: "USER", Value: "admin"},
+		{Name: "SSM_IGNORE_MISSING_SECRETS", Value: "false"},
+		{Name: "SSM_JSON_LOG", Value: "false"},
+		{Name: "SSM_AWS_REGION"},
+		{Name: "SSM_VARIABLE_OPTIONS", Value: `{"API_KEY":{"optional":true,"fileMode":true}}`},
+		{Name: "SSM_FILE_DIR", Value: "/mutate/secrets/app"},
+		{Name: "SSM_FILE_MODE", Value: "false"},
+	}
+	if got := podSpec.Containers[0].Env; !cmp.Equal(got, wantEnv) {
+		t.Errorf("mutatingWebhook.mutateContainers() env diff %v", cmp.Diff(got, wantEnv))
+	}
+}
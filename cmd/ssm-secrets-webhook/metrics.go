@@ -0,0 +1,113 @@
+// Copyright © 2020 Peter Wilson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+const metricsNamespace = "ssm_secrets_webhook"
+
+// reference sources
+const (
+	sourceEnv              = "env"
+	sourceEnvFromConfigMap = "envfrom_configmap"
+	sourceEnvFromSecret    = "envfrom_secret"
+	sourceValueFrom        = "valuefrom"
+	sourceArgs             = "args"
+	sourceManifest         = "annotation"
+)
+
+var (
+	podsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "pods_total",
+		Help:      "Pods reviewed by decision (mutated, skipped or denied).",
+	}, []string{"namespace", "decision"})
+
+	containersWrappedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "containers_wrapped_total",
+		Help:      "Containers wrapped with ssm-env.",
+	}, []string{"namespace"})
+
+	referencesFoundTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "references_found_total",
+		Help:      "SSM references found by source.",
+	}, []string{"source"})
+
+	lookupErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "lookup_errors_total",
+		Help:      "ConfigMap and Secret lookup errors by kind and reason.",
+	}, []string{"kind", "reason"})
+
+	registryLookupDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "registry_lookup_duration_seconds",
+		Help:      "Latency of image config lookups in the registry.",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	registryLookupFailuresTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "registry_lookup_failures_total",
+		Help:      "Failed image config lookups in the registry.",
+	})
+
+	degradedAdmissionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "degraded_admissions_total",
+		Help:      "Pods admitted despite a failed lookup, by lookup source and failure mode.",
+	}, []string{"source", "mode"})
+
+	configReloadsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "config_reloads_total",
+		Help:      "Config file reloads by result (success or failure).",
+	}, []string{"result"})
+
+	mutationDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "mutation_duration_seconds",
+		Help:      "Latency of pod mutations.",
+		Buckets:   prometheus.DefBuckets,
+	})
+)
+
+func registerMetrics(registerer prometheus.Registerer) {
+	registerer.MustRegister(
+		tlsCertificateExpiry,
+		podsTotal,
+		containersWrappedTotal,
+		referencesFoundTotal,
+		lookupErrorsTotal,
+		registryLookupDuration,
+		registryLookupFailuresTotal,
+		degradedAdmissionsTotal,
+		mutationDuration,
+		configReloadsTotal,
+	)
+}
+
+func recordLookupError(kind string, err error) {
+	reason := string(apierrors.ReasonForError(err))
+	if reason == "" {
+		reason = "Unknown"
+	}
+	lookupErrorsTotal.WithLabelValues(kind, reason).Inc()
+}
@@ -0,0 +1,76 @@
+// Copyright © 2020 Peter Wilson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	imagev1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+	whcontext "github.com/slok/kubewebhook/pkg/webhook/context"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	fake "k8s.io/client-go/kubernetes/fake"
+)
+
+func Test_mutatingWebhook_ssmSecretsMutator_metrics(t *testing.T) {
+	mw := &mutatingWebhook{
+		k8sClient: fake.NewSimpleClientset(),
+		registry:  &MockRegistry{Image: imagev1.ImageConfig{Entrypoint: []string{"/app"}}},
+		logger:    logrus.New(),
+	}
+	pod := &corev1.Pod{
+		Spec: corev1.PodSpec{
+			SecurityContext: &corev1.PodSecurityContext{},
+			Containers: []corev1.Container{
+				{Name: "app", Image: "app", Args: []string{"--token=ssm:/api/token"}, Env: []corev1.EnvVar{{Name: "DB_PASS", Value: "ssm:/prod/db/pass"}}},
+				{Name: "sidecar", Image: "sidecar"},
+			},
+		},
+	}
+
+	// the collectors are global, other tests add to them as well
+	counters := []struct {
+		name      string
+		collector prometheus.Collector
+		want      float64
+	}{
+		{name: "pods mutated", collector: podsTotal.WithLabelValues("metrics", decisionMutated), want: 1},
+		{name: "pods skipped", collector: podsTotal.WithLabelValues("metrics", decisionSkipped), want: 0},
+		{name: "containers wrapped", collector: containersWrappedTotal.WithLabelValues("metrics"), want: 1},
+		{name: "env references", collector: referencesFoundTotal.WithLabelValues(sourceEnv), want: 1},
+		{name: "args references", collector: referencesFoundTotal.WithLabelValues(sourceArgs), want: 1},
+	}
+	before := make([]float64, len(counters))
+	for i, counter := range counters {
+		before[i] = testutil.ToFloat64(counter.collector)
+	}
+
+	ctx := whcontext.SetAdmissionRequest(context.Background(), &admissionv1beta1.AdmissionRequest{UID: "1234", Namespace: "metrics"})
+	if _, err := mw.ssmSecretsMutator(ctx, pod); err != nil {
+		t.Fatalf("ssmSecretsMutator() error = %v", err)
+	}
+
+	for i, counter := range counters {
+		t.Run(counter.name, func(t *testing.T) {
+			if got := testutil.ToFloat64(counter.collector) - before[i]; got != counter.want {
+				t.Errorf("ssmSecretsMutator() %s increased by %v, want %v", counter.name, got, counter.want)
+			}
+		})
+	}
+}
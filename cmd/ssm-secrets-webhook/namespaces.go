@@ -0,0 +1,96 @@
+// Copyright © 2020 Peter Wilson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// newNamespaceLister starts an informer on namespaces and waits for its cache to sync
+func newNamespaceLister(k8sClient kubernetes.Interface, resync, syncTimeout time.Duration, stop <-chan struct{}) (corelisters.NamespaceLister, readinessCheck, error) {
+	factory := informers.NewSharedInformerFactory(k8sClient, resync)
+	informer := factory.Core().V1().Namespaces()
+	lister := informer.Lister()
+	synced := informer.Informer().HasSynced
+
+	factory.Start(stop)
+
+	if !waitForCacheSync(syncTimeout, synced) {
+		return nil, nil, fmt.Errorf("namespace cache not synced after %s", syncTimeout)
+	}
+
+	check := func() error {
+		if !synced() {
+			return fmt.Errorf("namespace cache not synced")
+		}
+		return nil
+	}
+	return lister, check, nil
+}
+
+// getNamespace returns the namespace from the informer cache, falling back to the API for
+// namespaces created since the last watch event
+func (mw *mutatingWebhook) getNamespace(ns string) (*corev1.Namespace, error) {
+	if mw.namespaces != nil {
+		namespace, err := mw.namespaces.Get(ns)
+		if err == nil {
+			return namespace, nil
+		}
+		if !apierrors.IsNotFound(err) {
+			return nil, err
+		}
+		mw.logger.Debugf("namespace %s not in cache, reading it from the API", ns)
+	}
+
+	namespace, err := mw.k8sClient.CoreV1().Namespaces().Get(ns, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: ns}}, nil
+	}
+	return namespace, err
+}
+
+// effectiveSettings applies namespace and then pod annotations over the global settings,
+// and then the SsmInjectionPolicies matching the namespace
+func (mw *mutatingWebhook) effectiveSettings(podAnnotations map[string]string, namespace *corev1.Namespace) (*webhookSettings, error) {
+	settings, err := mw.currentSettings().withAnnotations(namespace.Annotations, "namespace "+namespace.Name)
+	if err != nil {
+		return nil, err
+	}
+	settings, err = settings.withFailureModeAnnotations(namespace.Annotations, "namespace "+namespace.Name)
+	if err != nil {
+		return nil, err
+	}
+	settings, err = settings.withAnnotations(podAnnotations, "pod")
+	if err != nil {
+		return nil, err
+	}
+	return settings.withPolicies(mw.policies.list(), namespace), nil
+}
+
+func waitForCacheSync(timeout time.Duration, synced ...cache.InformerSynced) bool {
+	stop := make(chan struct{})
+	timer := time.AfterFunc(timeout, func() { close(stop) })
+	defer timer.Stop()
+	return cache.WaitForCacheSync(stop, synced...)
+}
@@ -0,0 +1,121 @@
+// Copyright © 2020 Peter Wilson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+
+	cmp "github.com/google/go-cmp/cmp"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	fake "k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func Test_mutatingWebhook_effectiveSettings(t *testing.T) {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	_ = indexer.Add(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a", Annotations: map[string]string{
+		"ssm.pwillie.github.io/aws-region":             "us-east-1",
+		"ssm.pwillie.github.io/role-arn":               "arn:aws:iam::123456789012:role/team-a",
+		"ssm.pwillie.github.io/ignore-missing-secrets": "true",
+		"ssm.pwillie.github.io/file-mode":              "true",
+	}}})
+	_ = indexer.Add(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "broken", Annotations: map[string]string{
+		"ssm.pwillie.github.io/role-arn": "team-a",
+	}}})
+	_ = indexer.Add(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "plain"}})
+
+	mw := &mutatingWebhook{k8sClient: fake.NewSimpleClientset(), logger: logrus.New(), namespaces: corelisters.NewNamespaceLister(indexer)}
+	mw.settings.Store(&webhookSettings{
+		Region:                "ap-southeast-2",
+		SsmEnvImage:           "pwillie/ssm-env:1.0.0",
+		SsmEnvImagePullPolicy: corev1.PullIfNotPresent,
+	})
+
+	tests := []struct {
+		name           string
+		ns             string
+		podAnnotations map[string]string
+		want           *webhookSettings
+		wantErr        bool
+	}{
+		{
+			name: "global settings",
+			ns:   "plain",
+			want: &webhookSettings{Region: "ap-southeast-2", SsmEnvImage: "pwillie/ssm-env:1.0.0", SsmEnvImagePullPolicy: corev1.PullIfNotPresent},
+		},
+		{
+			name: "namespace not in cache",
+			ns:   "new",
+			want: &webhookSettings{Region: "ap-southeast-2", SsmEnvImage: "pwillie/ssm-env:1.0.0", SsmEnvImagePullPolicy: corev1.PullIfNotPresent},
+		},
+		{
+			name: "namespace defaults",
+			ns:   "team-a",
+			want: &webhookSettings{
+				Region:                "us-east-1",
+				SsmEnvImage:           "pwillie/ssm-env:1.0.0",
+				SsmEnvImagePullPolicy: corev1.PullIfNotPresent,
+				IgnoreMissingSecrets:  true,
+				RoleARN:               "arn:aws:iam::123456789012:role/team-a",
+				FileMode:              true,
+			},
+		},
+		{
+			name: "pod annotations take precedence",
+			ns:   "team-a",
+			podAnnotations: map[string]string{
+				"ssm.pwillie.github.io/ignore-missing-secrets": "false",
+				"ssm.pwillie.github.io/file-mode":              "false",
+				"ssm.pwillie.github.io/ssm-env-image":          "registry.local/ssm-env:1.1.0",
+			},
+			want: &webhookSettings{
+				Region:                "us-east-1",
+				SsmEnvImage:           "registry.local/ssm-env:1.1.0",
+				SsmEnvImagePullPolicy: corev1.PullIfNotPresent,
+				RoleARN:               "arn:aws:iam::123456789012:role/team-a",
+			},
+		},
+		{
+			name:    "invalid namespace annotation",
+			ns:      "broken",
+			wantErr: true,
+		},
+		{
+			name:           "invalid pod annotation",
+			ns:             "plain",
+			podAnnotations: map[string]string{"ssm.pwillie.github.io/file-mode": "yes please"},
+			wantErr:        true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			namespace, err := mw.getNamespace(tt.ns)
+			if err != nil {
+				t.Fatalf("mutatingWebhook.getNamespace() error = %v", err)
+			}
+			got, err := mw.effectiveSettings(tt.podAnnotations, namespace)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("mutatingWebhook.effectiveSettings() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !cmp.Equal(got, tt.want) {
+				t.Errorf("mutatingWebhook.effectiveSettings() diff %v", cmp.Diff(got, tt.want))
+			}
+		})
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright © 2020 Peter Wilson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+var (
+	pathPlaceholder = regexp.MustCompile(`{[^{}]*}`)
+	pathVariable    = regexp.MustCompile(`\$\{([^{}]*)\}`)
+)
+
+// downwardAPIEnv maps the variables the webhook defines for parameter paths using them, when the
+// container doesn't, to their downward API field
+var downwardAPIEnv = map[string]string{
+	"POD_NAMESPACE": "metadata.namespace",
+	"POD_NAME":      "metadata.name",
+	"NODE_NAME":     "spec.nodeName",
+}
+
+// validatePathTemplate accepts an empty template, which leaves paths without a leading slash as
+// they are, or an absolute path using the {cluster}, {namespace} and {serviceAccount} placeholders
+func validatePathTemplate(template string) error {
+	if template == "" {
+		return nil
+	}
+	if !strings.HasPrefix(template, "/") {
+		return fmt.Errorf("%q must start with /", template)
+	}
+	for _, placeholder := range pathPlaceholder.FindAllString(template, -1) {
+		switch placeholder {
+		case "{cluster}", "{namespace}", "{serviceAccount}":
+		default:
+			return fmt.Errorf("%q has an unknown placeholder %s, expected {cluster}, {namespace} or {serviceAccount}", template, placeholder)
+		}
+	}
+	return nil
+}
+
+// pathPrefix returns the prefix of relative parameter paths for pods of the namespace running
+// as the service account, empty when relative paths aren't enabled
+func (s *webhookSettings) pathPrefix(ns, serviceAccount string) string {
+	if s.RelativePathTemplate == "" {
+		return ""
+	}
+	prefix := strings.NewReplacer(
+		"{cluster}", s.ClusterName,
+		"{namespace}", ns,
+		"{serviceAccount}", serviceAccount,
+	).Replace(s.RelativePathTemplate)
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return prefix
+}
+
+// resolvePath returns the absolute path of a parameter path, ssm-env resolves it the same way
+func resolvePath(prefix, path string) (string, bool) {
+	if prefix == "" || strings.HasPrefix(path, "/") {
+		return path, false
+	}
+	return prefix + path, true
+}
+
+func podServiceAccount(podSpec *corev1.PodSpec) string {
+	if podSpec == nil || podSpec.ServiceAccountName == "" {
+		return "default"
+	}
+	return podSpec.ServiceAccountName
+}
+
+// pathVariables returns the names of the ${VAR} variables ssm-env expands in a parameter path
+func pathVariables(path string) []string {
+	var names []string
+	for _, match := range pathVariable.FindAllStringSubmatch(path, -1) {
+		names = append(names, match[1])
+	}
+	return names
+}
+
+// literalPath returns the part of a parameter path before its first variable, the part known at
+// admission. That is a ${VAR} expanded by ssm-env, or a $(VAR) of the container left to the kubelet
+func literalPath(path string) string {
+	for _, variable := range []string{"${", "$("} {
+		if i := strings.Index(path, variable); i >= 0 {
+			path = path[:i]
+		}
+	}
+	return path
+}
+
+// pathVariableEnv checks the variables used by the parameter paths of the container are defined,
+// and returns downward API variables for those the webhook defines
+func pathVariableEnv(record *admissionRecord, container string, env *containerEnv, references []ssmReference) []corev1.EnvVar {
+	var envVars []corev1.EnvVar
+	defined := map[string]bool{}
+	for _, reference := range references {
+		for _, name := range pathVariables(reference.Path) {
+			switch {
+			case defined[name]:
+			case env.defines(name):
+				if env.prefix.isReference(env.values[name].value) {
+					record.warn("parameter path %s of container %s uses ${%s}, which holds an ssm reference that is not resolved in paths", reference.Path, container, name)
+				}
+			case downwardAPIEnv[name] != "":
+				envVars = append(envVars, corev1.EnvVar{
+					Name:      name,
+					ValueFrom: &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{FieldPath: downwardAPIEnv[name]}},
+				})
+			default:
+				record.warn("parameter path %s of container %s uses ${%s}, which is not defined in the container", reference.Path, container, name)
+			}
+			defined[name] = true
+		}
+	}
+	return envVars
+}
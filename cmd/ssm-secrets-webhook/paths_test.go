@@ -0,0 +1,251 @@
+// Copyright © 2020 Peter Wilson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	cmp "github.com/google/go-cmp/cmp"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	fake "k8s.io/client-go/kubernetes/fake"
+)
+
+func Test_validatePathTemplate(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		wantErr  bool
+	}{
+		{name: "disabled", template: ""},
+		{name: "all placeholders", template: "/{cluster}/{namespace}/{serviceAccount}/"},
+		{name: "relative", template: "{namespace}/", wantErr: true},
+		{name: "unknown placeholder", template: "/{env}/{namespace}/", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validatePathTemplate(tt.template); (err != nil) != tt.wantErr {
+				t.Errorf("validatePathTemplate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_webhookSettings_pathPrefix(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings webhookSettings
+		want     string
+	}{
+		{name: "disabled", settings: webhookSettings{}, want: ""},
+		{
+			name:     "placeholders",
+			settings: webhookSettings{RelativePathTemplate: "/{cluster}/{namespace}/{serviceAccount}/", ClusterName: "prod"},
+			want:     "/prod/team-a/api/",
+		},
+		{
+			name:     "trailing slash added",
+			settings: webhookSettings{RelativePathTemplate: "/apps/{namespace}"},
+			want:     "/apps/team-a/",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.settings.pathPrefix("team-a", "api"); got != tt.want {
+				t.Errorf("webhookSettings.pathPrefix() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_mutatingWebhook_mutateContainers_relativePaths(t *testing.T) {
+	settings := &webhookSettings{
+		RelativePathTemplate: "/{cluster}/{namespace}/{serviceAccount}/",
+		ClusterName:          "prod",
+		AllowedPathPrefixes:  [][]string{{"/prod/team-a/"}},
+	}
+	mw := &mutatingWebhook{k8sClient: fake.NewSimpleClientset(), logger: logrus.New()}
+
+	tests := []struct {
+		name           string
+		container      corev1.Container
+		wantReferences []ssmReference
+		wantPrefix     bool
+		wantErr        bool
+	}{
+		{
+			name: "relative and absolute paths",
+			container: corev1.Container{
+				Name:    "app",
+				Command: []string{"/app", "--token=ssm:api/token"},
+				Env: []corev1.EnvVar{
+					{Name: "DB_PASSWORD", Value: "ssm:db/password"},
+					{Name: "SHARED", Value: "ssm:/prod/team-a/shared"},
+				},
+			},
+			wantReferences: []ssmReference{
+				{Name: "DB_PASSWORD", Path: "/prod/team-a/api/db/password"},
+				{Name: "SHARED", Path: "/prod/team-a/shared"},
+				{Name: "args[1]", Path: "/prod/team-a/api/api/token"},
+			},
+			wantPrefix: true,
+		},
+		{
+			name: "absolute paths only",
+			container: corev1.Container{
+				Name:    "app",
+				Command: []string{"/app"},
+				Env:     []corev1.EnvVar{{Name: "SHARED", Value: "ssm:/prod/team-a/shared"}},
+			},
+			wantReferences: []ssmReference{{Name: "SHARED", Path: "/prod/team-a/shared"}},
+		},
+		{
+			name: "allowlist checks the resolved path",
+			container: corev1.Container{
+				Name:    "app",
+				Command: []string{"/app"},
+				Env:     []corev1.EnvVar{{Name: "OTHER", Value: "ssm:/prod/team-b/password"}},
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			record := &admissionRecord{}
+			ctx := withAdmissionRecord(context.Background(), record)
+			podSpec := &corev1.PodSpec{ServiceAccountName: "api", Containers: []corev1.Container{tt.container}}
+
+			_, err := mw.mutateContainers(ctx, podSpec.Containers, podSpec, settings, ssmConfig{}, "team-a", "")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("mutatingWebhook.mutateContainers() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			want := []containerRecord{{Name: "app", References: tt.wantReferences}}
+			if got := record.mutatedContainers(); !cmp.Equal(got, want) {
+				t.Errorf("mutatingWebhook.mutateContainers() diff %v", cmp.Diff(got, want))
+			}
+			gotPrefix := false
+			for _, env := range podSpec.Containers[0].Env {
+				if env.Name == "SSM_PATH_PREFIX" {
+					gotPrefix = env.Value == "/prod/team-a/api/"
+				}
+			}
+			if gotPrefix != tt.wantPrefix {
+				t.Errorf("mutatingWebhook.mutateContainers() SSM_PATH_PREFIX set = %v, want %v", gotPrefix, tt.wantPrefix)
+			}
+		})
+	}
+}
+
+func Test_mutatingWebhook_mutateContainers_pathVariables(t *testing.T) {
+	settings := &webhookSettings{AllowedPathPrefixes: [][]string{{"/app/"}}}
+	mw := &mutatingWebhook{k8sClient: fake.NewSimpleClientset(), logger: logrus.New()}
+	fieldRef := func(name, fieldPath string) corev1.EnvVar {
+		return corev1.EnvVar{Name: name, ValueFrom: &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{FieldPath: fieldPath}}}
+	}
+
+	tests := []struct {
+		name         string
+		env          []corev1.EnvVar
+		wantEnv      []corev1.EnvVar
+		wantWarnings []string
+		wantErr      bool
+	}{
+		{
+			name: "downward api variables",
+			env: []corev1.EnvVar{
+				{Name: "ENVIRONMENT", Value: "prod"},
+				{Name: "DB_PASSWORD", Value: "ssm:/app/${ENVIRONMENT}/${POD_NAMESPACE}/db"},
+				{Name: "NODE_TOKEN", Value: "ssm:/app/nodes/${NODE_NAME}"},
+				{Name: "CACHE_TOKEN", Value: "ssm:/app/${POD_NAMESPACE}/cache"},
+			},
+			wantEnv: []corev1.EnvVar{
+				fieldRef("POD_NAMESPACE", "metadata.namespace"),
+				fieldRef("NODE_NAME", "spec.nodeName"),
+			},
+		},
+		{
+			name: "variables defined by the container",
+			env: []corev1.EnvVar{
+				fieldRef("POD_NAME", "metadata.name"),
+				{Name: "DB_PASSWORD", Value: "ssm:/app/${POD_NAME}/db"},
+			},
+		},
+		{
+			name:         "undefined variable",
+			env:          []corev1.EnvVar{{Name: "DB_PASSWORD", Value: "ssm:/app/${ENVIRONMENT}/db"}},
+			wantWarnings: []string{"parameter path /app/${ENVIRONMENT}/db of container app uses ${ENVIRONMENT}, which is not defined in the container"},
+		},
+		{
+			name:    "allowlist checks the part before variables",
+			env:     []corev1.EnvVar{{Name: "DB_PASSWORD", Value: "ssm:/${ENVIRONMENT}/db"}},
+			wantErr: true,
+		},
+		{
+			name: "container variables expanded by the kubelet",
+			env: []corev1.EnvVar{
+				fieldRef("POD_NAMESPACE", "metadata.namespace"),
+				fieldRef("POD_IP", "status.podIP"),
+				{Name: "DB_PASSWORD", Value: "ssm:/app/$(POD_NAMESPACE)/db"},
+				{Name: "HOST_TOKEN", Value: "ssm:/app/hosts/$(POD_IP)"},
+			},
+		},
+		{
+			name: "allowlist checks the part before unknown container variables",
+			env: []corev1.EnvVar{
+				fieldRef("POD_IP", "status.podIP"),
+				{Name: "HOST_TOKEN", Value: "ssm:/$(POD_IP)/token"},
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			record := &admissionRecord{}
+			ctx := withAdmissionRecord(context.Background(), record)
+			containers := []corev1.Container{{Name: "app", Command: []string{"/app"}, Env: tt.env}}
+
+			_, err := mw.mutateContainers(ctx, containers, nil, settings, ssmConfig{}, "default", "")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("mutatingWebhook.mutateContainers() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			var gotEnv []corev1.EnvVar
+			for _, env := range containers[0].Env[len(tt.env):] {
+				if !strings.HasPrefix(env.Name, "SSM_") {
+					gotEnv = append(gotEnv, env)
+				}
+			}
+			if !cmp.Equal(gotEnv, tt.wantEnv) {
+				t.Errorf("mutatingWebhook.mutateContainers() env diff %v", cmp.Diff(gotEnv, tt.wantEnv))
+			}
+			if got := record.collectedWarnings(); !cmp.Equal(got, tt.wantWarnings) {
+				t.Errorf("mutatingWebhook.mutateContainers() warnings diff %v", cmp.Diff(got, tt.wantWarnings))
+			}
+		})
+	}
+}
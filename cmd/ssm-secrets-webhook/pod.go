@@ -19,15 +19,74 @@
 package main
 
 import (
-	"github.com/spf13/viper"
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
 )
 
-func (mw *mutatingWebhook) mutatePod(pod *corev1.Pod, ns string, dryRun bool) error {
+func (mw *mutatingWebhook) mutatePod(ctx context.Context, pod *corev1.Pod, namespace *corev1.Namespace, dryRun bool) (err error) {
+	ns := namespace.Name
+	ctx, span := tracer.Start(ctx, "mutatePod", trace.WithAttributes(namespaceAttribute.String(ns)))
+	defer func() { endSpan(span, err) }()
+
 	mw.logger.Debug("Successfully connected to the API")
 
-	initContainersMutated, err := mw.mutateContainers(pod.Spec.InitContainers, &pod.Spec, ns)
+	record := admissionRecordFrom(ctx)
+	if record == nil {
+		record = &admissionRecord{}
+		ctx = withAdmissionRecord(ctx, record)
+	}
+
+	inject, err := injectionEnabled(pod)
+	if err != nil {
+		return err
+	}
+
+	if !inject {
+		record.skip(fmt.Sprintf("injection is disabled by the %s annotation", injectAnnotation))
+		return nil
+	}
+
+	settings, err := mw.effectiveSettings(pod.GetAnnotations(), namespace)
+	if err != nil {
+		return err
+	}
+
+	prefix := settings.referencePrefix()
+	config, err := parseSsmConfig(pod, prefix)
+	if err != nil {
+		return err
+	}
+
+	if unknown := unknownManifestContainers(config.Secrets, &pod.Spec); len(unknown) > 0 {
+		record.warn("the %s annotation targets containers that aren't in the pod: %s", prefix.annotation(secretsAnnotation), strings.Join(unknown, ", "))
+	}
+
+	// mutate a copy so the pod can still be admitted as it is when injection fails
+	mutated := pod.DeepCopy()
+	if err := mw.mutatePodSpec(ctx, mutated, settings, config, ns); err != nil {
+		if !admitUnmutated(record, settings, err) && settings.FailureMode != failureModeAdmitUnmutated {
+			return err
+		}
+		record.discardContainers()
+		record.skip(fmt.Sprintf("injection failed and the %s failure mode admits the pod as it is: %s", failureModeAdmitUnmutated, err))
+		return nil
+	}
+	*pod = *mutated
+
+	return nil
+}
+
+func (mw *mutatingWebhook) mutatePodSpec(ctx context.Context, pod *corev1.Pod, settings *webhookSettings, config ssmConfig, ns string) error {
+	record := admissionRecordFrom(ctx)
+
+	initContainersMutated, err := mw.mutateContainers(ctx, pod.Spec.InitContainers, &pod.Spec, settings, config, ns, pod.Name)
 	if err != nil {
 		return err
 	}
@@ -38,7 +97,7 @@ func (mw *mutatingWebhook) mutatePod(pod *corev1.Pod, ns string, dryRun bool) er
 		mw.logger.Debug("No pod init containers were mutated")
 	}
 
-	containersMutated, err := mw.mutateContainers(pod.Spec.Containers, &pod.Spec, ns)
+	containersMutated, err := mw.mutateContainers(ctx, pod.Spec.Containers, &pod.Spec, settings, config, ns, pod.Name)
 	if err != nil {
 		return err
 	}
@@ -49,20 +108,21 @@ func (mw *mutatingWebhook) mutatePod(pod *corev1.Pod, ns string, dryRun bool) er
 		mw.logger.Debug("No pod containers were mutated")
 	}
 
+	prefix := settings.referencePrefix()
 	containerEnvVars := []corev1.EnvVar{}
 	containerVolMounts := []corev1.VolumeMount{
 		{
-			Name:      "ssm-env",
-			MountPath: "/mutate/",
+			Name:      prefix.volumeName(),
+			MountPath: prefix.mutateDir(),
 		},
 	}
 
 	if initContainersMutated || containersMutated {
-		pod.Spec.InitContainers = append(getInitContainers(pod.Spec.Containers, pod.Spec.SecurityContext, initContainersMutated, containersMutated, containerEnvVars, containerVolMounts), pod.Spec.InitContainers...)
+		pod.Spec.InitContainers = append(getInitContainers(pod.Spec.Containers, pod.Spec.SecurityContext, settings, initContainersMutated, containersMutated, containerEnvVars, containerVolMounts), pod.Spec.InitContainers...)
 		mw.logger.Debug("Successfully appended pod init containers to spec")
 
 		pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
-			Name: "ssm-env",
+			Name: prefix.volumeName(),
 			VolumeSource: corev1.VolumeSource{
 				EmptyDir: &corev1.EmptyDirVolumeSource{
 					Medium: corev1.StorageMediumMemory,
@@ -70,6 +130,11 @@ func (mw *mutatingWebhook) mutatePod(pod *corev1.Pod, ns string, dryRun bool) er
 			},
 		})
 		mw.logger.Debug("Successfully appended pod spec volume")
+
+		if err := annotatePod(pod, prefix, record.mutatedContainers(), settings.SsmEnvImage, settings.AnnotateReferencePaths, time.Now()); err != nil {
+			return err
+		}
+		mw.logger.Debug("Successfully annotated pod")
 	}
 
 	return nil
@@ -92,19 +157,20 @@ mountSearch:
 	return serviceAccountMount
 }
 
-func getInitContainers(originalContainers []corev1.Container, podSecurityContext *corev1.PodSecurityContext, initContainersMutated bool, containersMutated bool, containerEnvVars []corev1.EnvVar, containerVolMounts []corev1.VolumeMount) []corev1.Container {
+func getInitContainers(originalContainers []corev1.Container, podSecurityContext *corev1.PodSecurityContext, settings *webhookSettings, initContainersMutated bool, containersMutated bool, containerEnvVars []corev1.EnvVar, containerVolMounts []corev1.VolumeMount) []corev1.Container {
 	var containers = []corev1.Container{}
 
 	if initContainersMutated || containersMutated {
+		prefix := settings.referencePrefix()
 		containers = append(containers, corev1.Container{
-			Name:            "copy-ssm-env",
-			Image:           viper.GetString("ssm_env_image"),
-			ImagePullPolicy: corev1.PullPolicy(viper.GetString("ssm_env_image_pull_policy")),
-			Command:         []string{"sh", "-c", "cp /ssm-env /mutate/"},
+			Name:            prefix.initContainerName(),
+			Image:           settings.SsmEnvImage,
+			ImagePullPolicy: settings.SsmEnvImagePullPolicy,
+			Command:         []string{"sh", "-c", "cp /ssm-env " + prefix.mutateDir()},
 			VolumeMounts: []corev1.VolumeMount{
 				{
-					Name:      "ssm-env",
-					MountPath: "/mutate/",
+					Name:      prefix.volumeName(),
+					MountPath: prefix.mutateDir(),
 				},
 			},
 
@@ -121,6 +187,20 @@ func getInitContainers(originalContainers []corev1.Container, podSecurityContext
 	return containers
 }
 
+// wrappedBySsmEnv reports whether the container already runs through the ssm-env of the webhook,
+// possibly wrapped in turn by the ssm-env of a webhook using another prefix
+func wrappedBySsmEnv(container *corev1.Container, prefix referencePrefix) bool {
+	for _, arg := range append(append([]string{}, container.Command...), container.Args...) {
+		if arg == prefix.ssmEnvPath() {
+			return true
+		}
+		if path.Base(arg) != "ssm-env" || !strings.HasPrefix(arg, "/mutate") {
+			return false
+		}
+	}
+	return false
+}
+
 func getSecurityContext(podSecurityContext *corev1.PodSecurityContext) *corev1.SecurityContext {
 	if hasPodSecurityContextRunAsUser(podSecurityContext) {
 		return &corev1.SecurityContext{
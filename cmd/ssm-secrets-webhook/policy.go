@@ -0,0 +1,384 @@
+// Copyright © 2020 Peter Wilson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+)
+
+var policyResource = schema.GroupVersionResource{Group: "ssm.pwillie.github.io", Version: "v1alpha1", Resource: "ssminjectionpolicies"}
+
+// failureMode decides what happens to a pod when injection fails
+type failureMode string
+
+const (
+	// failureModeFail denies the pod
+	failureModeFail failureMode = "Fail"
+	// failureModeAdmitUnmutated admits the pod as it is, with a warning
+	failureModeAdmitUnmutated failureMode = "AdmitUnmutated"
+	// failureModeAdmitPartial leaves only the containers whose lookups failed unmutated, with a
+	// warning. It only applies to lookup failures
+	failureModeAdmitPartial failureMode = "AdmitPartial"
+)
+
+// ssmInjectionPolicy is the cluster scoped SsmInjectionPolicy custom resource
+type ssmInjectionPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   ssmInjectionPolicySpec   `json:"spec"`
+	Status ssmInjectionPolicyStatus `json:"status,omitempty"`
+
+	decodeErr error
+}
+
+type ssmInjectionPolicySpec struct {
+	// NamespaceSelector selects the namespaces the policy applies to, all namespaces when nil
+	NamespaceSelector   *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+	AllowedPathPrefixes []string              `json:"allowedPathPrefixes,omitempty"`
+	RequiredRoleARN     string                `json:"requiredRoleARN,omitempty"`
+	ForceFileMode       bool                  `json:"forceFileMode,omitempty"`
+	SsmEnvImage         string                `json:"ssmEnvImage,omitempty"`
+	FailureMode         failureMode           `json:"failureMode,omitempty"`
+}
+
+type ssmInjectionPolicyStatus struct {
+	ObservedGeneration int64             `json:"observedGeneration,omitempty"`
+	Conditions         []policyCondition `json:"conditions,omitempty"`
+}
+
+type policyCondition struct {
+	Type               string                 `json:"type"`
+	Status             corev1.ConditionStatus `json:"status"`
+	Reason             string                 `json:"reason,omitempty"`
+	Message            string                 `json:"message,omitempty"`
+	LastTransitionTime metav1.Time            `json:"lastTransitionTime,omitempty"`
+}
+
+const policyAcceptedCondition = "Accepted"
+
+func (p *ssmInjectionPolicy) validate() error {
+	if p.decodeErr != nil {
+		return p.decodeErr
+	}
+	if _, err := metav1.LabelSelectorAsSelector(p.Spec.NamespaceSelector); err != nil {
+		return fmt.Errorf("invalid namespaceSelector: %s", err)
+	}
+	for _, prefix := range p.Spec.AllowedPathPrefixes {
+		if !strings.HasPrefix(prefix, "/") {
+			return fmt.Errorf("invalid allowedPathPrefixes %q, prefixes must start with /", prefix)
+		}
+	}
+	if err := validateRoleARN(p.Spec.RequiredRoleARN); err != nil {
+		return fmt.Errorf("invalid requiredRoleARN: %s", err)
+	}
+	if p.Spec.SsmEnvImage != "" {
+		if err := validateImage(p.Spec.SsmEnvImage); err != nil {
+			return fmt.Errorf("invalid ssmEnvImage: %s", err)
+		}
+	}
+	switch p.Spec.FailureMode {
+	case "", failureModeFail, failureModeAdmitUnmutated:
+	default:
+		return fmt.Errorf("invalid failureMode %q, expected one of %s, %s", p.Spec.FailureMode, failureModeFail, failureModeAdmitUnmutated)
+	}
+	return nil
+}
+
+// matches reports whether the policy applies to the namespace. A policy whose selector is
+// invalid matches every namespace, like one that failed to decode, so it isn't silently skipped
+func (p *ssmInjectionPolicy) matches(namespace *corev1.Namespace) bool {
+	if p.Spec.NamespaceSelector == nil {
+		return true
+	}
+	selector, err := metav1.LabelSelectorAsSelector(p.Spec.NamespaceSelector)
+	if err != nil {
+		return true
+	}
+	return selector.Matches(labels.Set(namespace.Labels))
+}
+
+// withPolicies applies the policies matching the namespace over the settings. Policies are
+// merged in name order: path prefix lists all have to be satisfied, file mode is forced by any
+// policy and Fail wins over AdmitUnmutated. Invalid policies and conflicting role ARNs or
+// images set PolicyError, which only fails pods with references
+func (s webhookSettings) withPolicies(policies []*ssmInjectionPolicy, namespace *corev1.Namespace) *webhookSettings {
+	var roleARNFrom, imageFrom string
+
+	for _, policy := range policies {
+		if !policy.matches(namespace) {
+			continue
+		}
+		s.Policies = append(s.Policies, policy.Name)
+
+		if err := policy.validate(); err != nil {
+			s.failPolicies("SsmInjectionPolicy %s is invalid: %s", policy.Name, err)
+			// the failure mode of the policy is kept when it can be read
+			if policy.decodeErr == nil && policy.Spec.FailureMode == failureModeAdmitUnmutated {
+				s.mergeFailureMode(failureModeAdmitUnmutated)
+			} else {
+				s.mergeFailureMode(failureModeFail)
+			}
+			continue
+		}
+		s.mergeFailureMode(policy.Spec.FailureMode)
+
+		if len(policy.Spec.AllowedPathPrefixes) > 0 {
+			s.AllowedPathPrefixes = append(s.AllowedPathPrefixes, policy.Spec.AllowedPathPrefixes)
+		}
+
+		if arn := policy.Spec.RequiredRoleARN; arn != "" {
+			if roleARNFrom != "" && arn != s.RoleARN {
+				s.failPolicies("SsmInjectionPolicies %s and %s require different role ARNs", roleARNFrom, policy.Name)
+			} else {
+				s.RoleARN, roleARNFrom = arn, policy.Name
+			}
+		}
+
+		if image := policy.Spec.SsmEnvImage; image != "" {
+			if imageFrom != "" && image != s.SsmEnvImage {
+				s.failPolicies("SsmInjectionPolicies %s and %s pin different ssm-env images", imageFrom, policy.Name)
+			} else {
+				s.SsmEnvImage, imageFrom = image, policy.Name
+			}
+		}
+
+		if policy.Spec.ForceFileMode && s.FileModeForcedBy == "" {
+			s.FileMode, s.FileModeForcedBy = true, policy.Name
+		}
+	}
+
+	return &s
+}
+
+// failPolicies records the first reason the matching policies can't be applied
+func (s *webhookSettings) failPolicies(format string, args ...interface{}) {
+	if s.PolicyError == "" {
+		s.PolicyError = fmt.Sprintf(format, args...)
+	}
+}
+
+func (s *webhookSettings) mergeFailureMode(mode failureMode) {
+	switch mode {
+	case failureModeFail:
+		s.FailureMode = failureModeFail
+	case failureModeAdmitUnmutated:
+		if s.FailureMode != failureModeFail {
+			s.FailureMode = failureModeAdmitUnmutated
+		}
+	}
+}
+
+// pathAllowed reports whether the parameter path has one of the allowed prefixes of every policy
+func (s *webhookSettings) pathAllowed(path string) bool {
+	for _, prefixes := range s.AllowedPathPrefixes {
+		allowed := false
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(path, prefix) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+	return true
+}
+
+// policyStore keeps the SsmInjectionPolicies of the cluster and reports whether they were accepted
+type policyStore struct {
+	mu       sync.RWMutex
+	policies map[string]*ssmInjectionPolicy
+	client   dynamic.Interface
+	logger   logrus.FieldLogger
+}
+
+func newPolicyStore(client dynamic.Interface, logger logrus.FieldLogger) *policyStore {
+	return &policyStore{
+		policies: map[string]*ssmInjectionPolicy{},
+		client:   client,
+		logger:   logger,
+	}
+}
+
+// start runs an informer on SsmInjectionPolicies and waits for its cache to sync
+func (s *policyStore) start(resync, syncTimeout time.Duration, stop <-chan struct{}) (readinessCheck, error) {
+	factory := dynamicinformer.NewDynamicSharedInformerFactory(s.client, resync)
+	informer := factory.ForResource(policyResource).Informer()
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    s.update,
+		UpdateFunc: func(_, obj interface{}) { s.update(obj) },
+		DeleteFunc: s.delete,
+	})
+
+	factory.Start(stop)
+
+	if !waitForCacheSync(syncTimeout, informer.HasSynced) {
+		return nil, fmt.Errorf("SsmInjectionPolicy cache not synced after %s, is the CRD installed?", syncTimeout)
+	}
+
+	check := func() error {
+		if !informer.HasSynced() {
+			return fmt.Errorf("SsmInjectionPolicy cache not synced")
+		}
+		return nil
+	}
+	return check, nil
+}
+
+// list returns the policies ordered by name
+func (s *policyStore) list() []*ssmInjectionPolicy {
+	if s == nil {
+		return nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	policies := make([]*ssmInjectionPolicy, 0, len(s.policies))
+	for _, policy := range s.policies {
+		policies = append(policies, policy)
+	}
+	sort.Slice(policies, func(i, j int) bool { return policies[i].Name < policies[j].Name })
+	return policies
+}
+
+func (s *policyStore) set(policy *ssmInjectionPolicy) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.policies[policy.Name] = policy
+}
+
+func (s *policyStore) update(obj interface{}) {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+
+	policy := &ssmInjectionPolicy{}
+	if err := decodePolicy(u, policy); err != nil {
+		// kept, matching every namespace, so pods are denied rather than silently skipping the policy
+		s.logger.Errorf("error decoding SsmInjectionPolicy %s: %s", u.GetName(), err)
+		policy = &ssmInjectionPolicy{
+			ObjectMeta: metav1.ObjectMeta{Name: u.GetName(), Generation: u.GetGeneration()},
+			decodeErr:  fmt.Errorf("invalid policy: %s", err),
+		}
+	}
+	s.set(policy)
+
+	if err := s.reportStatus(u, policy); err != nil {
+		s.logger.Errorf("error updating status of SsmInjectionPolicy %s: %s", policy.Name, err)
+	}
+}
+
+// decodePolicy goes through JSON, the unstructured converter can't skip decodeErr
+func decodePolicy(u *unstructured.Unstructured, policy *ssmInjectionPolicy) error {
+	data, err := u.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, policy)
+}
+
+func (s *policyStore) delete(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.policies, u.GetName())
+}
+
+// reportStatus sets the Accepted condition of the policy, the status is only written when
+// it changed so replicas of the webhook don't keep updating it. The current status is read
+// from the object, as policies that fail to decode have none
+func (s *policyStore) reportStatus(u *unstructured.Unstructured, policy *ssmInjectionPolicy) error {
+	condition := policyCondition{
+		Type:    policyAcceptedCondition,
+		Status:  corev1.ConditionTrue,
+		Reason:  "Valid",
+		Message: "policy is applied to matching namespaces",
+	}
+	if err := policy.validate(); err != nil {
+		condition.Status = corev1.ConditionFalse
+		condition.Reason = "Invalid"
+		condition.Message = fmt.Sprintf("%s, pods with references fail in every namespace", err)
+	}
+
+	observedGeneration, _, _ := unstructured.NestedInt64(u.Object, "status", "observedGeneration")
+	existing, _, _ := unstructured.NestedSlice(u.Object, "status", "conditions")
+
+	var conditions []interface{}
+	var lastTransitionTime interface{}
+	for _, c := range existing {
+		fields, ok := c.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if fields["type"] != policyAcceptedCondition {
+			conditions = append(conditions, fields)
+			continue
+		}
+		if fields["status"] == string(condition.Status) && fields["reason"] == condition.Reason && fields["message"] == condition.Message {
+			lastTransitionTime = fields["lastTransitionTime"]
+		}
+	}
+	if lastTransitionTime != nil && observedGeneration == u.GetGeneration() {
+		return nil
+	}
+
+	if lastTransitionTime == nil {
+		condition.LastTransitionTime = metav1.Now()
+	}
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&condition)
+	if err != nil {
+		return err
+	}
+	if lastTransitionTime != nil {
+		content["lastTransitionTime"] = lastTransitionTime
+	}
+	conditions = append(conditions, content)
+
+	updated := u.DeepCopy()
+	if err := unstructured.SetNestedField(updated.Object, u.GetGeneration(), "status", "observedGeneration"); err != nil {
+		return err
+	}
+	if err := unstructured.SetNestedSlice(updated.Object, conditions, "status", "conditions"); err != nil {
+		return err
+	}
+	_, err = s.client.Resource(policyResource).UpdateStatus(updated, metav1.UpdateOptions{})
+	return err
+}
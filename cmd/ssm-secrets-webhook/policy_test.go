@@ -0,0 +1,362 @@
+// Copyright © 2020 Peter Wilson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	cmp "github.com/google/go-cmp/cmp"
+	imagev1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	fake "k8s.io/client-go/kubernetes/fake"
+)
+
+func Test_webhookSettings_withPolicies(t *testing.T) {
+	namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a", Labels: map[string]string{"team": "a"}}}
+	teamA := &metav1.LabelSelector{MatchLabels: map[string]string{"team": "a"}}
+	teamB := &metav1.LabelSelector{MatchLabels: map[string]string{"team": "b"}}
+	invalidSelector := &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{{Key: "team", Operator: "Near"}}}
+	global := webhookSettings{Region: "ap-southeast-2", SsmEnvImage: "pwillie/ssm-env:1.0.0", RoleARN: "arn:aws:iam::123456789012:role/pod"}
+
+	policy := func(name string, spec ssmInjectionPolicySpec) *ssmInjectionPolicy {
+		return &ssmInjectionPolicy{ObjectMeta: metav1.ObjectMeta{Name: name}, Spec: spec}
+	}
+
+	tests := []struct {
+		name     string
+		policies []*ssmInjectionPolicy
+		want     *webhookSettings
+	}{
+		{
+			name: "no policies",
+			want: &global,
+		},
+		{
+			name: "policy of another namespace",
+			policies: []*ssmInjectionPolicy{
+				policy("team-b", ssmInjectionPolicySpec{NamespaceSelector: teamB, ForceFileMode: true}),
+			},
+			want: &global,
+		},
+		{
+			name: "merged policies",
+			policies: []*ssmInjectionPolicy{
+				policy("cluster", ssmInjectionPolicySpec{AllowedPathPrefixes: []string{"/shared/", "/team-a/"}, FailureMode: failureModeAdmitUnmutated}),
+				policy("team-a", ssmInjectionPolicySpec{
+					NamespaceSelector:   teamA,
+					AllowedPathPrefixes: []string{"/team-a/"},
+					RequiredRoleARN:     "arn:aws:iam::123456789012:role/team-a",
+					ForceFileMode:       true,
+					SsmEnvImage:         "registry.local/ssm-env:1.0.0",
+					FailureMode:         failureModeFail,
+				}),
+				policy("team-b", ssmInjectionPolicySpec{NamespaceSelector: teamB, RequiredRoleARN: "arn:aws:iam::123456789012:role/team-b"}),
+			},
+			want: &webhookSettings{
+				Region:              "ap-southeast-2",
+				SsmEnvImage:         "registry.local/ssm-env:1.0.0",
+				RoleARN:             "arn:aws:iam::123456789012:role/team-a",
+				FileMode:            true,
+				Policies:            []string{"cluster", "team-a"},
+				AllowedPathPrefixes: [][]string{{"/shared/", "/team-a/"}, {"/team-a/"}},
+				FailureMode:         failureModeFail,
+				FileModeForcedBy:    "team-a",
+			},
+		},
+		{
+			name: "conflicting role ARNs",
+			policies: []*ssmInjectionPolicy{
+				policy("a", ssmInjectionPolicySpec{RequiredRoleARN: "arn:aws:iam::123456789012:role/a", FailureMode: failureModeAdmitUnmutated}),
+				policy("b", ssmInjectionPolicySpec{NamespaceSelector: teamA, RequiredRoleARN: "arn:aws:iam::123456789012:role/b"}),
+			},
+			want: &webhookSettings{
+				Region:      "ap-southeast-2",
+				SsmEnvImage: "pwillie/ssm-env:1.0.0",
+				RoleARN:     "arn:aws:iam::123456789012:role/a",
+				Policies:    []string{"a", "b"},
+				FailureMode: failureModeAdmitUnmutated,
+				PolicyError: "SsmInjectionPolicies a and b require different role ARNs",
+			},
+		},
+		{
+			name: "invalid matching policy",
+			policies: []*ssmInjectionPolicy{
+				policy("a", ssmInjectionPolicySpec{FailureMode: "Sometimes"}),
+			},
+			want: &webhookSettings{
+				Region:      "ap-southeast-2",
+				SsmEnvImage: "pwillie/ssm-env:1.0.0",
+				RoleARN:     "arn:aws:iam::123456789012:role/pod",
+				Policies:    []string{"a"},
+				FailureMode: failureModeFail,
+				PolicyError: `SsmInjectionPolicy a is invalid: invalid failureMode "Sometimes", expected one of Fail, AdmitUnmutated`,
+			},
+		},
+		{
+			name: "invalid selector matches with its failure mode",
+			policies: []*ssmInjectionPolicy{
+				policy("a", ssmInjectionPolicySpec{NamespaceSelector: invalidSelector, FailureMode: failureModeAdmitUnmutated}),
+			},
+			want: &webhookSettings{
+				Region:      "ap-southeast-2",
+				SsmEnvImage: "pwillie/ssm-env:1.0.0",
+				RoleARN:     "arn:aws:iam::123456789012:role/pod",
+				Policies:    []string{"a"},
+				FailureMode: failureModeAdmitUnmutated,
+				PolicyError: `SsmInjectionPolicy a is invalid: invalid namespaceSelector: "Near" is not a valid pod selector operator`,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := global.withPolicies(tt.policies, namespace)
+			if !cmp.Equal(got, tt.want) {
+				t.Errorf("webhookSettings.withPolicies() diff %v", cmp.Diff(got, tt.want))
+			}
+		})
+	}
+}
+
+func Test_mutatingWebhook_mutatePod_policy(t *testing.T) {
+	tests := []struct {
+		name        string
+		failureMode failureMode
+		wantErr     bool
+		wantSkipped bool
+	}{
+		{name: "denied", failureMode: failureModeFail, wantErr: true},
+		{name: "admitted unmutated", failureMode: failureModeAdmitUnmutated, wantSkipped: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newPolicyStore(dynamicfake.NewSimpleDynamicClient(runtime.NewScheme()), logrus.New())
+			store.set(&ssmInjectionPolicy{
+				ObjectMeta: metav1.ObjectMeta{Name: "team-a"},
+				Spec:       ssmInjectionPolicySpec{AllowedPathPrefixes: []string{"/team-a/"}, FailureMode: tt.failureMode},
+			})
+			mw := &mutatingWebhook{
+				k8sClient: fake.NewSimpleClientset(),
+				registry:  &MockRegistry{Image: imagev1.ImageConfig{Entrypoint: []string{"/app"}}},
+				logger:    logrus.New(),
+				policies:  store,
+			}
+
+			pod := &corev1.Pod{
+				Spec: corev1.PodSpec{
+					SecurityContext: &corev1.PodSecurityContext{},
+					Containers: []corev1.Container{
+						{Name: "app", Image: "app", Env: []corev1.EnvVar{{Name: "OK", Value: "ssm:/team-a/ok"}}},
+						{Name: "sidecar", Image: "sidecar", Env: []corev1.EnvVar{{Name: "OTHER", Value: "ssm:/team-b/secret"}}},
+					},
+				},
+			}
+			original := pod.DeepCopy()
+
+			record := &admissionRecord{}
+			err := mw.mutatePod(withAdmissionRecord(context.Background(), record), pod, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a"}}, false)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("mutatingWebhook.mutatePod() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !cmp.Equal(pod, original) {
+				t.Errorf("mutatingWebhook.mutatePod() mutated the pod, diff %v", cmp.Diff(pod, original))
+			}
+			if skipped := record.skipped() != ""; skipped != tt.wantSkipped {
+				t.Errorf("mutatingWebhook.mutatePod() skipped = %v, want %v", skipped, tt.wantSkipped)
+			}
+			if containers := record.mutatedContainers(); tt.wantSkipped && len(containers) != 0 {
+				t.Errorf("mutatingWebhook.mutatePod() recorded containers %v", containers)
+			}
+		})
+	}
+}
+
+func Test_mutatingWebhook_mutatePod_invalidPolicy(t *testing.T) {
+	tests := []struct {
+		name        string
+		env         []corev1.EnvVar
+		failureMode failureMode
+		wantErr     bool
+		wantSkipped bool
+	}{
+		{name: "pod with references denied", env: []corev1.EnvVar{{Name: "OK", Value: "ssm:/team-a/ok"}}, failureMode: failureModeFail, wantErr: true},
+		{name: "pod with references admitted unmutated", env: []corev1.EnvVar{{Name: "OK", Value: "ssm:/team-a/ok"}}, failureMode: failureModeAdmitUnmutated, wantSkipped: true},
+		{name: "pod without references admitted", env: []corev1.EnvVar{{Name: "PLAIN", Value: "plain"}}, failureMode: failureModeFail},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newPolicyStore(dynamicfake.NewSimpleDynamicClient(runtime.NewScheme()), logrus.New())
+			store.set(&ssmInjectionPolicy{
+				ObjectMeta: metav1.ObjectMeta{Name: "team-a"},
+				Spec: ssmInjectionPolicySpec{
+					NamespaceSelector: &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{{Key: "team", Operator: "Near"}}},
+					FailureMode:       tt.failureMode,
+				},
+			})
+			mw := &mutatingWebhook{
+				k8sClient: fake.NewSimpleClientset(),
+				registry:  &MockRegistry{Image: imagev1.ImageConfig{Entrypoint: []string{"/app"}}},
+				logger:    logrus.New(),
+				policies:  store,
+			}
+
+			pod := &corev1.Pod{Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: "app", Env: tt.env}}}}
+			original := pod.DeepCopy()
+
+			record := &admissionRecord{}
+			err := mw.mutatePod(withAdmissionRecord(context.Background(), record), pod, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a"}}, false)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("mutatingWebhook.mutatePod() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !cmp.Equal(pod, original) {
+				t.Errorf("mutatingWebhook.mutatePod() mutated the pod, diff %v", cmp.Diff(pod, original))
+			}
+			if skipped := record.skipped() != ""; skipped != tt.wantSkipped {
+				t.Errorf("mutatingWebhook.mutatePod() skipped = %v, want %v", skipped, tt.wantSkipped)
+			}
+		})
+	}
+}
+
+func Test_mutatingWebhook_mutateContainers_allowedPrefixes(t *testing.T) {
+	mw := &mutatingWebhook{k8sClient: fake.NewSimpleClientset(), logger: logrus.New()}
+	settings := &webhookSettings{AllowedPathPrefixes: [][]string{{"/team-a/", "/shared/"}, {"/team-a/"}}}
+	containers := []corev1.Container{{Name: "app", Command: []string{"/app"}, Env: []corev1.EnvVar{{Name: "OK", Value: "ssm:/team-a/ok"}}}}
+
+	if _, err := mw.mutateContainers(withAdmissionRecord(context.Background(), &admissionRecord{}), containers, nil, settings, ssmConfig{}, "team-a", ""); err != nil {
+		t.Fatalf("mutatingWebhook.mutateContainers() error = %v", err)
+	}
+
+	var got string
+	for _, env := range containers[0].Env {
+		if env.Name == "SSM_ALLOWED_PREFIXES" {
+			got = env.Value
+		}
+	}
+	if want := `[["/team-a/","/shared/"],["/team-a/"]]`; got != want {
+		t.Errorf("mutatingWebhook.mutateContainers() SSM_ALLOWED_PREFIXES = %v, want %v", got, want)
+	}
+}
+
+func Test_policyStore_update(t *testing.T) {
+	newPolicy := func(generation int64, failureMode string, spec ...string) *unstructured.Unstructured {
+		fields := map[string]interface{}{"failureMode": failureMode}
+		for i := 0; i+1 < len(spec); i += 2 {
+			fields[spec[i]] = spec[i+1]
+		}
+		return &unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": "ssm.pwillie.github.io/v1alpha1",
+			"kind":       "SsmInjectionPolicy",
+			"metadata":   map[string]interface{}{"name": "team-a", "generation": generation},
+			"spec":       fields,
+		}}
+	}
+
+	tests := []struct {
+		name       string
+		policy     *unstructured.Unstructured
+		wantStatus string
+		wantReason string
+	}{
+		{name: "valid", policy: newPolicy(1, "Fail"), wantStatus: "True", wantReason: "Valid"},
+		{name: "invalid", policy: newPolicy(2, "Sometimes"), wantStatus: "False", wantReason: "Invalid"},
+		{name: "undecodable", policy: newPolicy(3, "Fail", "allowedPathPrefixes", "/team-a/"), wantStatus: "False", wantReason: "Invalid"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), tt.policy)
+			store := newPolicyStore(client, logrus.New())
+
+			store.update(tt.policy)
+
+			if policies := store.list(); len(policies) != 1 || policies[0].Name != "team-a" {
+				t.Fatalf("policyStore.update() policies = %v", policies)
+			}
+
+			updated, err := client.Resource(policyResource).Get("team-a", metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			conditions, _, _ := unstructured.NestedSlice(updated.Object, "status", "conditions")
+			if len(conditions) != 1 {
+				t.Fatalf("policyStore.update() conditions = %v", conditions)
+			}
+			condition := conditions[0].(map[string]interface{})
+			if condition["type"] != "Accepted" || condition["status"] != tt.wantStatus || condition["reason"] != tt.wantReason {
+				t.Errorf("policyStore.update() condition = %v", condition)
+			}
+			if generation, _, _ := unstructured.NestedInt64(updated.Object, "status", "observedGeneration"); generation != tt.policy.GetGeneration() {
+				t.Errorf("policyStore.update() observedGeneration = %v, want %v", generation, tt.policy.GetGeneration())
+			}
+
+			// the update event of the status write must not write it again
+			writes := len(client.Actions())
+			store.update(updated)
+			if actions := client.Actions()[writes:]; len(actions) != 0 {
+				t.Errorf("policyStore.update() of an unchanged policy made %d more requests", len(actions))
+			}
+
+			store.delete(updated)
+			if policies := store.list(); len(policies) != 0 {
+				t.Errorf("policyStore.delete() policies = %v", policies)
+			}
+		})
+	}
+}
+
+func Test_mutatingWebhook_mutateContainers_forcedFileMode(t *testing.T) {
+	manifest, err := parseSecretManifest(`
+DB_PASSWORD: {path: /db/pass, fileMode: false}
+API_KEY: {path: /api/key, optional: true, fileMode: false}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := &ssmInjectionPolicy{ObjectMeta: metav1.ObjectMeta{Name: "files"}, Spec: ssmInjectionPolicySpec{ForceFileMode: true}}
+	settings := webhookSettings{}.withPolicies([]*ssmInjectionPolicy{policy}, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}})
+	mw := &mutatingWebhook{k8sClient: fake.NewSimpleClientset(), logger: logrus.New()}
+	containers := []corev1.Container{{Name: "app", Command: []string{"/app"}}}
+
+	record := &admissionRecord{}
+	if _, err := mw.mutateContainers(withAdmissionRecord(context.Background(), record), containers, nil, settings, ssmConfig{Secrets: manifest}, "default", ""); err != nil {
+		t.Fatalf("mutatingWebhook.mutateContainers() error = %v", err)
+	}
+
+	got := map[string]string{}
+	for _, env := range containers[0].Env {
+		got[env.Name] = env.Value
+	}
+	if got["SSM_FILE_DIR"] != "/mutate/secrets/app" {
+		t.Errorf("mutatingWebhook.mutateContainers() SSM_FILE_DIR = %q, want file mode", got["SSM_FILE_DIR"])
+	}
+	if value, ok := got["SSM_FILE_MODE"]; ok {
+		t.Errorf("mutatingWebhook.mutateContainers() SSM_FILE_MODE = %q, want it unset", value)
+	}
+	if want := `{"API_KEY":{"optional":true}}`; got["SSM_VARIABLE_OPTIONS"] != want {
+		t.Errorf("mutatingWebhook.mutateContainers() SSM_VARIABLE_OPTIONS = %v, want %v", got["SSM_VARIABLE_OPTIONS"], want)
+	}
+	if warnings := record.collectedWarnings(); len(warnings) != 2 {
+		t.Errorf("mutatingWebhook.mutateContainers() warnings = %v, want the fileMode options ignored", warnings)
+	}
+}
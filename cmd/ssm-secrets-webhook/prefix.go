@@ -0,0 +1,141 @@
+// Copyright © 2020 Peter Wilson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// defaultReferencePrefix is the prefix ssm-env uses when SSM_REFERENCE_PREFIX isn't set
+const defaultReferencePrefix referencePrefix = "ssm:"
+
+// referencePrefixName is the part of a prefix before ":", it names the init container, volume
+// and pod annotations of the webhook, so it must fit the 63 characters of an annotation name
+// once "injected-ssm-env-image-" is added
+var referencePrefixName = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]{0,38}[a-z0-9])?$`)
+
+// referencePrefix marks the values that are ssm references. The prefix followed by ":" escapes
+// a value starting with the prefix, ssm-env passes it on with that ":" removed. ssm-env matches
+// values the same way
+type referencePrefix string
+
+func validateReferencePrefix(prefix string) error {
+	switch {
+	case prefix == "":
+		return fmt.Errorf("the prefix is empty")
+	case !strings.HasSuffix(prefix, ":"):
+		return fmt.Errorf("%q must end with :", prefix)
+	case !referencePrefixName.MatchString(strings.TrimSuffix(prefix, ":")):
+		return fmt.Errorf("%q must be at most 40 lowercase alphanumeric characters or - followed by :", prefix)
+	}
+	return nil
+}
+
+func (p referencePrefix) isReference(value string) bool {
+	return strings.HasPrefix(value, string(p)) && !p.isEscaped(value)
+}
+
+func (p referencePrefix) isEscaped(value string) bool {
+	return strings.HasPrefix(value, string(p)+":")
+}
+
+// path returns the parameter path of a reference
+func (p referencePrefix) path(value string) string {
+	return strings.TrimPrefix(value, string(p))
+}
+
+// argValue returns the part of a command line argument that may be a reference or an escaped
+// value: the argument as a whole, or the value of a flag=ssm:path argument
+func (p referencePrefix) argValue(arg string) (string, bool) {
+	if strings.HasPrefix(arg, string(p)) {
+		return arg, true
+	}
+	if i := strings.Index(arg, "="+string(p)); i >= 0 {
+		return arg[i+1:], true
+	}
+	return "", false
+}
+
+// argReference returns the parameter path of a command line argument that is an ssm reference
+// as a whole, or a flag=ssm:path argument
+func (p referencePrefix) argReference(arg string) (string, bool) {
+	value, ok := p.argValue(arg)
+	if !ok || !p.isReference(value) {
+		return "", false
+	}
+	return p.path(value), true
+}
+
+// rewritesArgs reports whether ssm-env changes any of the arguments, to substitute a reference
+// or to unescape a value
+func (p referencePrefix) rewritesArgs(args []string) bool {
+	for _, arg := range args {
+		if _, ok := p.argValue(arg); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// referencePrefix returns the prefix of ssm references, the default one when it isn't set
+func (s *webhookSettings) referencePrefix() referencePrefix {
+	if s.ReferencePrefix == "" {
+		return defaultReferencePrefix
+	}
+	return s.ReferencePrefix
+}
+
+// The init container, volume and mount directory of ssm-env, the variables set for it and the
+// secrets and recorded pod annotations are named after the prefix when it isn't the default one. Webhooks using different prefixes then
+// mutate the same pod side by side, the ssm-env of one wrapping the ssm-env of the other, and
+// each ssm-env finds its variables from the directory it runs from
+
+func (p referencePrefix) nameSuffix() string {
+	if p == defaultReferencePrefix {
+		return ""
+	}
+	return "-" + strings.TrimSuffix(string(p), ":")
+}
+
+func (p referencePrefix) volumeName() string {
+	return "ssm-env" + p.nameSuffix()
+}
+
+func (p referencePrefix) initContainerName() string {
+	return "copy-ssm-env" + p.nameSuffix()
+}
+
+// mutateDir is where the init container copies ssm-env to, it holds the secret files and the
+// exec handler cache as well
+func (p referencePrefix) mutateDir() string {
+	return "/mutate" + p.nameSuffix() + "/"
+}
+
+func (p referencePrefix) ssmEnvPath() string {
+	return p.mutateDir() + "ssm-env"
+}
+
+// annotation returns the name of a pod annotation, ssm.pwillie.github.io/secrets-ssm-eu for the
+// prefix ssm-eu:
+func (p referencePrefix) annotation(annotation string) string {
+	return annotation + p.nameSuffix()
+}
+
+// envName returns the name of an ssm-env variable, SSM_FILE_DIR_SSM_EU for the prefix ssm-eu:
+func (p referencePrefix) envName(name string) string {
+	return name + strings.ToUpper(strings.Replace(p.nameSuffix(), "-", "_", -1))
+}
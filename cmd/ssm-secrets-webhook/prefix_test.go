@@ -0,0 +1,294 @@
+// Copyright © 2020 Peter Wilson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	cmp "github.com/google/go-cmp/cmp"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	fake "k8s.io/client-go/kubernetes/fake"
+)
+
+func Test_validateReferencePrefix(t *testing.T) {
+	tests := []struct {
+		prefix  string
+		wantErr bool
+	}{
+		{prefix: "ssm:"},
+		{prefix: "ssm-eu:"},
+		{prefix: "", wantErr: true},
+		{prefix: "ssm", wantErr: true},
+		{prefix: "ssm=:", wantErr: true},
+		{prefix: "s sm:", wantErr: true},
+		{prefix: "SSM:", wantErr: true},
+		{prefix: "ssm_eu:", wantErr: true},
+		{prefix: "-ssm:", wantErr: true},
+		{prefix: "ssm" + strings.Repeat("x", 37) + ":"},
+		{prefix: "ssm" + strings.Repeat("x", 38) + ":", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.prefix, func(t *testing.T) {
+			if err := validateReferencePrefix(tt.prefix); (err != nil) != tt.wantErr {
+				t.Errorf("validateReferencePrefix() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_referencePrefix_isReference(t *testing.T) {
+	tests := []struct {
+		value       string
+		wantRef     bool
+		wantEscaped bool
+	}{
+		{value: "ssm:/db/pass", wantRef: true},
+		{value: "ssm::literal", wantEscaped: true},
+		{value: "plain"},
+		{value: "ssm-eu:/db/pass"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			if got := defaultReferencePrefix.isReference(tt.value); got != tt.wantRef {
+				t.Errorf("referencePrefix.isReference() = %v, want %v", got, tt.wantRef)
+			}
+			if got := defaultReferencePrefix.isEscaped(tt.value); got != tt.wantEscaped {
+				t.Errorf("referencePrefix.isEscaped() = %v, want %v", got, tt.wantEscaped)
+			}
+		})
+	}
+}
+
+func Test_referencePrefix_names(t *testing.T) {
+	tests := []struct {
+		prefix            referencePrefix
+		wantInitContainer string
+		wantVolume        string
+		wantSsmEnv        string
+		wantEnv           string
+		wantAnnotation    string
+	}{
+		{
+			prefix:            defaultReferencePrefix,
+			wantInitContainer: "copy-ssm-env",
+			wantVolume:        "ssm-env",
+			wantSsmEnv:        "/mutate/ssm-env",
+			wantEnv:           "SSM_FILE_DIR",
+			wantAnnotation:    "ssm.pwillie.github.io/secrets",
+		},
+		{
+			prefix:            "ssm-eu:",
+			wantInitContainer: "copy-ssm-env-ssm-eu",
+			wantVolume:        "ssm-env-ssm-eu",
+			wantSsmEnv:        "/mutate-ssm-eu/ssm-env",
+			wantEnv:           "SSM_FILE_DIR_SSM_EU",
+			wantAnnotation:    "ssm.pwillie.github.io/secrets-ssm-eu",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.prefix), func(t *testing.T) {
+			if got := tt.prefix.initContainerName(); got != tt.wantInitContainer {
+				t.Errorf("referencePrefix.initContainerName() = %v, want %v", got, tt.wantInitContainer)
+			}
+			if got := tt.prefix.volumeName(); got != tt.wantVolume {
+				t.Errorf("referencePrefix.volumeName() = %v, want %v", got, tt.wantVolume)
+			}
+			if got := tt.prefix.ssmEnvPath(); got != tt.wantSsmEnv {
+				t.Errorf("referencePrefix.ssmEnvPath() = %v, want %v", got, tt.wantSsmEnv)
+			}
+			if got := tt.prefix.envName("SSM_FILE_DIR"); got != tt.wantEnv {
+				t.Errorf("referencePrefix.envName() = %v, want %v", got, tt.wantEnv)
+			}
+			if got := tt.prefix.annotation(secretsAnnotation); got != tt.wantAnnotation {
+				t.Errorf("referencePrefix.annotation() = %v, want %v", got, tt.wantAnnotation)
+			}
+		})
+	}
+}
+
+func Test_mutatingWebhook_mutateContainers_referencePrefix(t *testing.T) {
+	mw := &mutatingWebhook{k8sClient: fake.NewSimpleClientset(), logger: logrus.New()}
+
+	tests := []struct {
+		name           string
+		settings       *webhookSettings
+		container      corev1.Container
+		wantMutated    bool
+		wantReferences []ssmReference
+		wantPrefixEnv  bool
+		wantCommand    []string
+	}{
+		{
+			name:     "configured prefix",
+			settings: &webhookSettings{ReferencePrefix: "ssm-eu:"},
+			container: corev1.Container{
+				Name:    "app",
+				Command: []string{"/app", "--token=ssm-eu:/api/token"},
+				Env: []corev1.EnvVar{
+					{Name: "DB_PASSWORD", Value: "ssm-eu:/db/pass"},
+					{Name: "OTHER", Value: "ssm:/other/pass"},
+				},
+			},
+			wantMutated: true,
+			wantReferences: []ssmReference{
+				{Name: "DB_PASSWORD", Path: "/db/pass"},
+				{Name: "args[1]", Path: "/api/token"},
+			},
+			wantPrefixEnv: true,
+			wantCommand:   []string{"/mutate-ssm-eu/ssm-env"},
+		},
+		{
+			name:     "wrapped by the ssm-env of another prefix",
+			settings: &webhookSettings{ReferencePrefix: "ssm-eu:"},
+			container: corev1.Container{
+				Name:    "app",
+				Command: []string{"/mutate/ssm-env"},
+				Args:    []string{"/app"},
+				Env: []corev1.EnvVar{
+					{Name: "DB_PASSWORD", Value: "ssm-eu:/db/pass"},
+					{Name: "OTHER", Value: "ssm:/other/pass"},
+				},
+			},
+			wantMutated:    true,
+			wantReferences: []ssmReference{{Name: "DB_PASSWORD", Path: "/db/pass"}},
+			wantPrefixEnv:  true,
+			wantCommand:    []string{"/mutate-ssm-eu/ssm-env"},
+		},
+		{
+			name:     "already wrapped",
+			settings: &webhookSettings{ReferencePrefix: "ssm-eu:"},
+			container: corev1.Container{
+				Name:    "app",
+				Command: []string{"/mutate/ssm-env"},
+				Args:    []string{"/mutate-ssm-eu/ssm-env", "/app"},
+				Env:     []corev1.EnvVar{{Name: "DB_PASSWORD", Value: "ssm-eu:/db/pass"}},
+			},
+		},
+		{
+			name:     "escaped values only",
+			settings: &webhookSettings{},
+			container: corev1.Container{
+				Name:    "app",
+				Command: []string{"/app"},
+				Env:     []corev1.EnvVar{{Name: "NOTE", Value: "ssm::literal"}},
+			},
+			wantMutated:    true,
+			wantReferences: []ssmReference{},
+			wantCommand:    []string{"/mutate/ssm-env"},
+		},
+		{
+			name:     "other prefix only",
+			settings: &webhookSettings{ReferencePrefix: "ssm-eu:"},
+			container: corev1.Container{
+				Name:    "app",
+				Command: []string{"/app"},
+				Env:     []corev1.EnvVar{{Name: "OTHER", Value: "ssm:/other/pass"}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			record := &admissionRecord{}
+			ctx := withAdmissionRecord(context.Background(), record)
+			containers := []corev1.Container{tt.container}
+
+			mutated, err := mw.mutateContainers(ctx, containers, nil, tt.settings, ssmConfig{}, "default", "")
+			if err != nil {
+				t.Fatalf("mutatingWebhook.mutateContainers() error = %v", err)
+			}
+			if mutated != tt.wantMutated {
+				t.Fatalf("mutatingWebhook.mutateContainers() = %v, want %v", mutated, tt.wantMutated)
+			}
+			if !tt.wantMutated {
+				return
+			}
+
+			want := []containerRecord{{Name: "app", References: tt.wantReferences}}
+			if got := record.mutatedContainers(); !cmp.Equal(got, want) {
+				t.Errorf("mutatingWebhook.mutateContainers() diff %v", cmp.Diff(got, want))
+			}
+			gotPrefixEnv := false
+			for _, env := range containers[0].Env {
+				if env.Name == tt.settings.referencePrefix().envName("SSM_REFERENCE_PREFIX") {
+					gotPrefixEnv = env.Value == string(tt.settings.ReferencePrefix)
+				}
+			}
+			if gotPrefixEnv != tt.wantPrefixEnv {
+				t.Errorf("mutatingWebhook.mutateContainers() SSM_REFERENCE_PREFIX set = %v, want %v", gotPrefixEnv, tt.wantPrefixEnv)
+			}
+			if got := containers[0].Command; !cmp.Equal(got, tt.wantCommand) {
+				t.Errorf("mutatingWebhook.mutateContainers() command = %v, want %v", got, tt.wantCommand)
+			}
+		})
+	}
+}
+
+func Test_mutatingWebhook_mutatePod_twoWebhooks(t *testing.T) {
+	newWebhook := func(prefix referencePrefix, image string) *mutatingWebhook {
+		mw := &mutatingWebhook{k8sClient: fake.NewSimpleClientset(), logger: logrus.New()}
+		mw.settings.Store(&webhookSettings{ReferencePrefix: prefix, SsmEnvImage: image})
+		return mw
+	}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{
+			"ssm.pwillie.github.io/secrets":        "DB_PASS: /db/pass",
+			"ssm.pwillie.github.io/secrets-ssm-eu": "EU_TOKEN: /eu/token",
+		}},
+		Spec: corev1.PodSpec{
+			SecurityContext: &corev1.PodSecurityContext{},
+			Containers:      []corev1.Container{{Name: "app", Image: "app", Command: []string{"/app"}}},
+		},
+	}
+	namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}}
+
+	// the second webhook sees the pod as mutated by the first
+	for _, mw := range []*mutatingWebhook{newWebhook(defaultReferencePrefix, "ssm-env:1"), newWebhook("ssm-eu:", "ssm-env:2")} {
+		if err := mw.mutatePod(context.Background(), pod, namespace, false); err != nil {
+			t.Fatalf("mutatingWebhook.mutatePod() error = %v", err)
+		}
+	}
+
+	references := map[string]string{}
+	for _, env := range pod.Spec.Containers[0].Env {
+		if env.Name == "DB_PASS" || env.Name == "EU_TOKEN" {
+			references[env.Name] = env.Value
+		}
+	}
+	if want := map[string]string{"DB_PASS": "ssm:/db/pass", "EU_TOKEN": "ssm-eu:/eu/token"}; !cmp.Equal(references, want) {
+		t.Errorf("mutatingWebhook.mutatePod() references diff %v", cmp.Diff(references, want))
+	}
+	if got, want := pod.Spec.Containers[0].Command, []string{"/mutate-ssm-eu/ssm-env"}; !cmp.Equal(got, want) {
+		t.Errorf("mutatingWebhook.mutatePod() command = %v, want %v", got, want)
+	}
+
+	for annotation, want := range map[string]string{
+		"ssm.pwillie.github.io/injected-env":                  `{"app":["DB_PASS"]}`,
+		"ssm.pwillie.github.io/injected-ssm-env-image":        "ssm-env:1",
+		"ssm.pwillie.github.io/injected-env-ssm-eu":           `{"app":["EU_TOKEN"]}`,
+		"ssm.pwillie.github.io/injected-ssm-env-image-ssm-eu": "ssm-env:2",
+	} {
+		if got := pod.Annotations[annotation]; got != want {
+			t.Errorf("mutatingWebhook.mutatePod() %s = %v, want %v", annotation, got, want)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright © 2020 Peter Wilson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"k8s.io/client-go/kubernetes"
+)
+
+// readinessCheck returns an error while the subsystem it checks isn't ready
+type readinessCheck func() error
+
+type checkResult struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type readinessResult struct {
+	Status string                 `json:"status"`
+	Checks map[string]checkResult `json:"checks"`
+}
+
+// readinessChecker serves /readyz, running every registered check on each request
+type readinessChecker struct {
+	mu      sync.RWMutex
+	names   []string
+	checks  map[string]readinessCheck
+	timeout time.Duration
+}
+
+func newReadinessChecker(timeout time.Duration) *readinessChecker {
+	return &readinessChecker{
+		checks:  map[string]readinessCheck{},
+		timeout: timeout,
+	}
+}
+
+func (c *readinessChecker) add(name string, check readinessCheck) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.checks[name]; !ok {
+		c.names = append(c.names, name)
+	}
+	c.checks[name] = check
+}
+
+func (c *readinessChecker) run(check readinessCheck) error {
+	result := make(chan error, 1)
+	go func() { result <- check() }()
+
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(c.timeout):
+		return fmt.Errorf("check timed out after %s", c.timeout)
+	}
+}
+
+func (c *readinessChecker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mu.RLock()
+	names := append([]string(nil), c.names...)
+	checks := make(map[string]readinessCheck, len(c.checks))
+	for name, check := range c.checks {
+		checks[name] = check
+	}
+	c.mu.RUnlock()
+
+	result := readinessResult{Status: "ok", Checks: make(map[string]checkResult, len(names))}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, name := range names {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			check := checkResult{Status: "ok"}
+			if err := c.run(checks[name]); err != nil {
+				check = checkResult{Status: "failed", Error: err.Error()}
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			result.Checks[name] = check
+			if check.Status != "ok" {
+				result.Status = "failed"
+			}
+		}(name)
+	}
+	wg.Wait()
+
+	w.Header().Set("Content-Type", "application/json")
+	if result.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(result)
+}
+
+func kubernetesCheck(k8sClient kubernetes.Interface) readinessCheck {
+	return func() error {
+		_, err := k8sClient.Discovery().ServerVersion()
+		return err
+	}
+}
+
+func tlsCheck(keypair *keypairReloader) readinessCheck {
+	return func() error {
+		cert := keypair.certificate()
+		if cert == nil || cert.Leaf == nil {
+			return fmt.Errorf("no serving certificate loaded")
+		}
+		now := time.Now()
+		if now.Before(cert.Leaf.NotBefore) {
+			return fmt.Errorf("serving certificate not valid before %s", cert.Leaf.NotBefore.Format(time.RFC3339))
+		}
+		if now.After(cert.Leaf.NotAfter) {
+			return fmt.Errorf("serving certificate expired at %s", cert.Leaf.NotAfter.Format(time.RFC3339))
+		}
+		return nil
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright © 2020 Peter Wilson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	fake "k8s.io/client-go/kubernetes/fake"
+)
+
+func Test_readinessChecker(t *testing.T) {
+	readiness := newReadinessChecker(50 * time.Millisecond)
+	readiness.add("kubernetes", kubernetesCheck(fake.NewSimpleClientset()))
+
+	rec := httptest.NewRecorder()
+	readiness.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("readinessChecker status = %v, want %v: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+
+	readiness.add("cache", func() error { return errors.New("not synced") })
+	readiness.add("slow", func() error { time.Sleep(time.Second); return nil })
+
+	rec = httptest.NewRecorder()
+	readiness.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("readinessChecker status = %v, want %v", rec.Code, http.StatusServiceUnavailable)
+	}
+
+	var result readinessResult
+	if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Checks["kubernetes"].Status != "ok" || result.Checks["cache"].Error != "not synced" || result.Checks["slow"].Status != "failed" {
+		t.Errorf("readinessChecker result = %+v", result)
+	}
+}
@@ -0,0 +1,387 @@
+// Copyright © 2020 Peter Wilson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/banzaicloud/bank-vaults/cmd/vault-secrets-webhook/registry"
+	"github.com/docker/distribution/manifest/manifestlist"
+	"github.com/docker/distribution/manifest/schema2"
+	dockerregistry "github.com/heroku/docker-registry-client/registry"
+	imagev1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/patrickmn/go-cache"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	archLabel = "kubernetes.io/arch"
+	osLabel   = "kubernetes.io/os"
+)
+
+var errNotAnImageIndex = fmt.Errorf("image is not a multi-platform image index")
+
+// registryUnavailableError is a failure to reach a registry or to read the image from it, the
+// registry failure mode applies to it. Invalid image references and pull secrets are errors of
+// the pod rather than of the registry, so they are not
+type registryUnavailableError struct {
+	err error
+}
+
+func (e *registryUnavailableError) Error() string {
+	return e.err.Error()
+}
+
+func (e *registryUnavailableError) Unwrap() error {
+	return e.err
+}
+
+// registryFailures are the messages the wrapped registry reports failures to reach a registry
+// or to read the image with, its other errors are about pull secrets
+var registryFailures = []string{
+	"cannot create client for registry:",
+	"cannot download manifest for image:",
+	"cannot download blob:",
+	"cannot read blob:",
+}
+
+func classifyRegistryError(err error) error {
+	for _, prefix := range registryFailures {
+		if strings.HasPrefix(err.Error(), prefix) {
+			return &registryUnavailableError{err: err}
+		}
+	}
+	return err
+}
+
+// platformRegistry resolves multi-platform image indexes to the image config of the platform
+// the pod is scheduled on, falling back to the wrapped registry for single platform images
+type platformRegistry struct {
+	registry.ImageRegistry
+	defaultPlatform   imagev1.Platform
+	skipVerify        bool
+	defaultPullSecret pullSecret
+	imageCache        *cache.Cache
+	logger            logrus.FieldLogger
+}
+
+type pullSecret struct{ namespace, name string }
+
+func newPlatformRegistry(defaultPlatform string, logger logrus.FieldLogger) (registry.ImageRegistry, error) {
+	platform, err := parsePlatform(defaultPlatform)
+	if err != nil {
+		return nil, err
+	}
+
+	// registry settings are restart-only, they are read once
+	return &platformRegistry{
+		ImageRegistry:     registry.NewRegistry(),
+		defaultPlatform:   platform,
+		skipVerify:        viper.GetBool("registry_skip_verify"),
+		defaultPullSecret: pullSecret{viper.GetString("default_image_pull_secret_namespace"), viper.GetString("default_image_pull_secret")},
+		imageCache:        cache.New(viper.GetDuration("registry_cache_ttl"), viper.GetDuration("registry_cache_ttl")),
+		logger:            logger,
+	}, nil
+}
+
+func parsePlatform(platform string) (imagev1.Platform, error) {
+	parts := strings.Split(platform, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return imagev1.Platform{}, fmt.Errorf("invalid platform %q, expected os/arch[/variant]", platform)
+	}
+
+	p := imagev1.Platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		p.Variant = parts[2]
+	}
+	return p, nil
+}
+
+func platformString(p imagev1.Platform) string {
+	if p.Variant != "" {
+		return fmt.Sprintf("%s/%s/%s", p.OS, p.Architecture, p.Variant)
+	}
+	return fmt.Sprintf("%s/%s", p.OS, p.Architecture)
+}
+
+// podPlatform returns the platform the pod will be scheduled on based on its nodeSelector
+// and required nodeAffinity, using the default for anything not constrained
+func podPlatform(podSpec *corev1.PodSpec, defaultPlatform imagev1.Platform) imagev1.Platform {
+	platform := defaultPlatform
+	if podSpec == nil {
+		return platform
+	}
+
+	osName, arch := podSpec.NodeSelector[osLabel], podSpec.NodeSelector[archLabel]
+
+	if podSpec.Affinity != nil && podSpec.Affinity.NodeAffinity != nil && podSpec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution != nil {
+		for _, term := range podSpec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms {
+			for _, expr := range term.MatchExpressions {
+				if expr.Operator != corev1.NodeSelectorOpIn || len(expr.Values) == 0 {
+					continue
+				}
+				if expr.Key == osLabel && osName == "" {
+					osName = expr.Values[0]
+				}
+				if expr.Key == archLabel && arch == "" {
+					arch = expr.Values[0]
+				}
+			}
+		}
+	}
+
+	if osName != "" {
+		platform.OS = osName
+	}
+	if arch != "" && arch != platform.Architecture {
+		platform.Architecture = arch
+		platform.Variant = ""
+	}
+	return platform
+}
+
+// GetImageConfig returns entrypoint and command of the container image for the pod platform
+func (r *platformRegistry) GetImageConfig(clientset kubernetes.Interface, namespace string, container *corev1.Container, podSpec *corev1.PodSpec) (*imagev1.ImageConfig, error) {
+	platform := podPlatform(podSpec, r.defaultPlatform)
+	logger := r.logger.WithFields(logrus.Fields{"image": container.Image, "platform": platformString(platform)})
+	logger.Info("resolving image config")
+
+	if err := validateImage(container.Image); err != nil {
+		return nil, err
+	}
+
+	cacheKey := container.Image + "|" + platformString(platform)
+	allowToCache := registry.IsAllowedToCache(container)
+	if allowToCache {
+		if imageConfig, found := r.imageCache.Get(cacheKey); found {
+			return imageConfig.(*imagev1.ImageConfig), nil
+		}
+	}
+
+	imageConfig, err := r.getPlatformImageConfig(clientset, namespace, container, podSpec, platform)
+	if err == errNotAnImageIndex {
+		// the wrapped registry caches forever, it is bypassed so that only the cache below
+		// with its TTL applies
+		uncached := container.DeepCopy()
+		uncached.ImagePullPolicy = corev1.PullAlways
+		imageConfig, err = r.ImageRegistry.GetImageConfig(clientset, namespace, uncached, podSpec)
+	}
+	if err != nil {
+		return nil, classifyRegistryError(err)
+	}
+
+	if allowToCache {
+		r.imageCache.Set(cacheKey, imageConfig, cache.DefaultExpiration)
+	}
+	return imageConfig, nil
+}
+
+func (r *platformRegistry) getPlatformImageConfig(clientset kubernetes.Interface, namespace string, container *corev1.Container, podSpec *corev1.PodSpec, platform imagev1.Platform) (*imagev1.ImageConfig, error) {
+	registryName, repository, reference := parseImageReference(container.Image)
+
+	username, password, err := findRegistryCredentials(clientset, namespace, podSpec, r.defaultPullSecret, registryName)
+	if err != nil {
+		return nil, err
+	}
+
+	var hub *dockerregistry.Registry
+	if r.skipVerify {
+		hub, err = dockerregistry.NewInsecure("https://"+registryName, username, password)
+	} else {
+		hub, err = dockerregistry.New("https://"+registryName, username, password)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot create client for registry: %s", err)
+	}
+	hub.Logf = dockerregistry.Quiet
+
+	mediaType, body, err := getManifest(hub, repository, reference, manifestlist.MediaTypeManifestList, imagev1.MediaTypeImageIndex, schema2.MediaTypeManifest, imagev1.MediaTypeImageManifest)
+	if err != nil {
+		return nil, err
+	}
+	if mediaType != manifestlist.MediaTypeManifestList && mediaType != imagev1.MediaTypeImageIndex {
+		return nil, errNotAnImageIndex
+	}
+
+	var index imagev1.Index
+	if err := json.Unmarshal(body, &index); err != nil {
+		return nil, fmt.Errorf("cannot unmarshal image index: %s", err)
+	}
+
+	descriptor := selectPlatformManifest(index.Manifests, platform)
+	if descriptor == nil {
+		return nil, fmt.Errorf("image index has no manifest for platform %s", platformString(platform))
+	}
+
+	_, body, err = getManifest(hub, repository, descriptor.Digest.String(), schema2.MediaTypeManifest, imagev1.MediaTypeImageManifest)
+	if err != nil {
+		return nil, err
+	}
+
+	var manifest imagev1.Manifest
+	if err := json.Unmarshal(body, &manifest); err != nil {
+		return nil, fmt.Errorf("cannot unmarshal image manifest: %s", err)
+	}
+
+	reader, err := hub.DownloadBlob(repository, manifest.Config.Digest)
+	if err != nil {
+		return nil, fmt.Errorf("cannot download blob: %s", err)
+	}
+	defer reader.Close()
+
+	blob, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read blob: %s", err)
+	}
+
+	var image imagev1.Image
+	if err := json.Unmarshal(blob, &image); err != nil {
+		return nil, fmt.Errorf("cannot unmarshal image config: %s", err)
+	}
+
+	return &image.Config, nil
+}
+
+func getManifest(hub *dockerregistry.Registry, repository, reference string, mediaTypes ...string) (string, []byte, error) {
+	url := fmt.Sprintf("%s/v2/%s/manifests/%s", hub.URL, repository, reference)
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return "", nil, err
+	}
+	req.Header.Set("Accept", strings.Join(mediaTypes, ", "))
+
+	resp, err := hub.Client.Do(req)
+	if err != nil {
+		return "", nil, fmt.Errorf("cannot download manifest for image: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", nil, fmt.Errorf("cannot download manifest for image: %s", resp.Status)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", nil, fmt.Errorf("cannot read manifest: %s", err)
+	}
+
+	return resp.Header.Get("Content-Type"), body, nil
+}
+
+func selectPlatformManifest(manifests []imagev1.Descriptor, platform imagev1.Platform) *imagev1.Descriptor {
+	var candidate *imagev1.Descriptor
+	for i, m := range manifests {
+		if m.Platform == nil || m.Platform.OS != platform.OS || m.Platform.Architecture != platform.Architecture {
+			continue
+		}
+		if platform.Variant == "" || m.Platform.Variant == platform.Variant {
+			return &manifests[i]
+		}
+		if candidate == nil {
+			candidate = &manifests[i]
+		}
+	}
+	return candidate
+}
+
+// parseImageReference splits an image into registry, repository and tag or digest,
+// applying the DockerHub defaults
+func parseImageReference(image string) (string, string, string) {
+	registryName := "index.docker.io"
+	repository := image
+
+	if slash := strings.Index(image, "/"); slash != -1 {
+		if host := image[:slash]; strings.ContainsAny(host, ".:") || host == "localhost" {
+			registryName, repository = host, image[slash+1:]
+		}
+	}
+	if registryName == "docker.io" {
+		registryName = "index.docker.io"
+	}
+	if registryName == "index.docker.io" && !strings.Contains(repository, "/") {
+		repository = "library/" + repository
+	}
+
+	reference := "latest"
+	if at := strings.Index(repository, "@"); at != -1 {
+		repository, reference = repository[:at], repository[at+1:]
+		if colon := strings.Index(repository, ":"); colon != -1 {
+			repository = repository[:colon]
+		}
+	} else if colon := strings.LastIndex(repository, ":"); colon != -1 {
+		repository, reference = repository[:colon], repository[colon+1:]
+	}
+
+	return registryName, repository, reference
+}
+
+// findRegistryCredentials looks up the credentials of the registry in the pod imagePullSecrets
+// and the default imagePullSecret, returning empty credentials for public registries
+func findRegistryCredentials(clientset kubernetes.Interface, namespace string, podSpec *corev1.PodSpec, defaultPullSecret pullSecret, registryName string) (string, string, error) {
+	var secrets []pullSecret
+	if podSpec != nil {
+		for _, s := range podSpec.ImagePullSecrets {
+			secrets = append(secrets, pullSecret{namespace, s.Name})
+		}
+	}
+	if defaultPullSecret.name != "" && defaultPullSecret.namespace != "" {
+		secrets = append(secrets, defaultPullSecret)
+	}
+
+	for _, s := range secrets {
+		secret, err := clientset.CoreV1().Secrets(s.namespace).Get(s.name, metav1.GetOptions{})
+		if err != nil {
+			return "", "", fmt.Errorf("cannot read imagePullSecret '%s' in namespace '%s': %s", s.name, s.namespace, err)
+		}
+
+		var creds registry.DockerCreds
+		if err := json.Unmarshal(secret.Data[corev1.DockerConfigJsonKey], &creds); err != nil {
+			continue
+		}
+
+		for name, auth := range creds.Auths {
+			name = strings.TrimPrefix(name, "https://")
+			name = strings.TrimSuffix(strings.TrimSuffix(strings.TrimSuffix(name, "/v1/"), "/v2/"), "/")
+			if name == "docker.io" {
+				name = "index.docker.io"
+			}
+			if name != registryName {
+				continue
+			}
+
+			if auth.Username != "" && auth.Password != "" {
+				return auth.Username, auth.Password, nil
+			}
+			decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+			if err != nil {
+				return "", "", fmt.Errorf("failed to decode auth field for registry %s: %s", name, err)
+			}
+			if split := strings.SplitN(string(decoded), ":", 2); len(split) == 2 {
+				return split[0], split[1], nil
+			}
+		}
+	}
+
+	return "", "", nil
+}
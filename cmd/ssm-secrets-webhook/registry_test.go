@@ -0,0 +1,242 @@
+// Copyright © 2020 Peter Wilson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	dockerregistry "github.com/heroku/docker-registry-client/registry"
+	imagev1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/patrickmn/go-cache"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	fake "k8s.io/client-go/kubernetes/fake"
+)
+
+func Test_podPlatform(t *testing.T) {
+	defaultPlatform := imagev1.Platform{OS: "linux", Architecture: "amd64"}
+
+	tests := []struct {
+		name    string
+		podSpec *corev1.PodSpec
+		want    string
+	}{
+		{name: "Will use default platform without constraints",
+			podSpec: &corev1.PodSpec{},
+			want:    "linux/amd64",
+		},
+		{name: "Will use nodeSelector",
+			podSpec: &corev1.PodSpec{
+				NodeSelector: map[string]string{archLabel: "arm64"},
+			},
+			want: "linux/arm64",
+		},
+		{name: "Will use required nodeAffinity",
+			podSpec: &corev1.PodSpec{
+				Affinity: &corev1.Affinity{
+					NodeAffinity: &corev1.NodeAffinity{
+						RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{
+							NodeSelectorTerms: []corev1.NodeSelectorTerm{
+								{MatchExpressions: []corev1.NodeSelectorRequirement{
+									{Key: archLabel, Operator: corev1.NodeSelectorOpIn, Values: []string{"arm64", "amd64"}},
+									{Key: osLabel, Operator: corev1.NodeSelectorOpIn, Values: []string{"windows"}},
+								}},
+							},
+						},
+					},
+				},
+			},
+			want: "windows/arm64",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := platformString(podPlatform(tt.podSpec, defaultPlatform)); got != tt.want {
+				t.Errorf("podPlatform() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_parseImageReference(t *testing.T) {
+	tests := []struct {
+		image                           string
+		registry, repository, reference string
+	}{
+		{"nginx", "index.docker.io", "library/nginx", "latest"},
+		{"bitnami/nginx:1.17", "index.docker.io", "bitnami/nginx", "1.17"},
+		{"registry.local:5000/team/app:v1", "registry.local:5000", "team/app", "v1"},
+		{"ghcr.io/team/app:v1@sha256:abc", "ghcr.io", "team/app", "sha256:abc"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.image, func(t *testing.T) {
+			registry, repository, reference := parseImageReference(tt.image)
+			if registry != tt.registry || repository != tt.repository || reference != tt.reference {
+				t.Errorf("parseImageReference() = %v, %v, %v, want %v, %v, %v", registry, repository, reference, tt.registry, tt.repository, tt.reference)
+			}
+		})
+	}
+}
+
+func Test_classifyRegistryError(t *testing.T) {
+	tests := []struct {
+		err             string
+		wantUnavailable bool
+	}{
+		{err: "cannot create client for registry: dial tcp: i/o timeout", wantUnavailable: true},
+		{err: "cannot download manifest for image: 503 Service Unavailable", wantUnavailable: true},
+		{err: "cannot download blob: unexpected EOF", wantUnavailable: true},
+		{err: "cannot read blob: unexpected EOF", wantUnavailable: true},
+		{err: "cannot read imagePullSecret 'pull' in namespace 'default': not found"},
+		{err: "cannot unmarshal docker configuration from imagePullSecret: unexpected end of JSON input"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.err, func(t *testing.T) {
+			var unavailable *registryUnavailableError
+			if got := errors.As(classifyRegistryError(errors.New(tt.err)), &unavailable); got != tt.wantUnavailable {
+				t.Errorf("classifyRegistryError() unavailable = %v, want %v", got, tt.wantUnavailable)
+			}
+		})
+	}
+}
+
+func Test_platformRegistry_GetImageConfig_invalidImage(t *testing.T) {
+	r := &platformRegistry{
+		ImageRegistry: &MockRegistry{Err: errors.New("cannot download manifest for image: timeout")},
+		logger:        logrus.New(),
+	}
+
+	_, err := r.GetImageConfig(fake.NewSimpleClientset(), "default", &corev1.Container{Name: "app", Image: "Registry.Local/App:1.0"}, nil)
+	var unavailable *registryUnavailableError
+	if err == nil || errors.As(err, &unavailable) {
+		t.Errorf("platformRegistry.GetImageConfig() error = %v, want an invalid image reference", err)
+	}
+}
+
+func Test_getManifest(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/team/app/manifests/v1":
+			w.Header().Set("Content-Type", imagev1.MediaTypeImageIndex)
+			w.Write([]byte(`{"manifests":[]}`))
+		case "/v2/team/app/manifests/unauthorized":
+			http.Error(w, `{"errors":[{"code":"UNAUTHORIZED"}]}`, http.StatusUnauthorized)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	hub := &dockerregistry.Registry{URL: server.URL, Client: server.Client()}
+
+	tests := []struct {
+		reference     string
+		wantMediaType string
+		wantBody      string
+		wantErr       bool
+	}{
+		{reference: "v1", wantMediaType: imagev1.MediaTypeImageIndex, wantBody: `{"manifests":[]}`},
+		{reference: "unauthorized", wantErr: true},
+		{reference: "missing", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.reference, func(t *testing.T) {
+			mediaType, body, err := getManifest(hub, "team/app", tt.reference, imagev1.MediaTypeImageIndex)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("getManifest() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if mediaType != tt.wantMediaType || string(body) != tt.wantBody {
+				t.Errorf("getManifest() = %v, %s, want %v, %s", mediaType, body, tt.wantMediaType, tt.wantBody)
+			}
+		})
+	}
+}
+
+func Test_platformRegistry_GetImageConfig_fallback(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/team/index/manifests/v1":
+			w.Header().Set("Content-Type", imagev1.MediaTypeImageIndex)
+			w.Write([]byte(`{"manifests":[{"digest":"sha256:0000000000000000000000000000000000000000000000000000000000000000","platform":{"os":"linux","architecture":"amd64"}}]}`))
+		case "/v2/team/single/manifests/v1":
+			w.Header().Set("Content-Type", imagev1.MediaTypeImageManifest)
+			w.Write([]byte(`{}`))
+		default:
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "https://")
+	arm64 := &corev1.PodSpec{NodeSelector: map[string]string{archLabel: "arm64"}}
+
+	tests := []struct {
+		name            string
+		image           string
+		wantFallback    bool
+		wantErr         bool
+		wantUnavailable bool
+	}{
+		{name: "single platform image", image: host + "/team/single:v1", wantFallback: true},
+		{name: "no manifest for the platform", image: host + "/team/index:v1", wantErr: true},
+		{name: "registry unavailable", image: host + "/team/down:v1", wantErr: true, wantUnavailable: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fallback := &fallbackRegistry{}
+			r := &platformRegistry{
+				ImageRegistry:   fallback,
+				defaultPlatform: imagev1.Platform{OS: "linux", Architecture: "amd64"},
+				skipVerify:      true,
+				imageCache:      cache.New(time.Minute, time.Minute),
+				logger:          logrus.New(),
+			}
+
+			_, err := r.GetImageConfig(fake.NewSimpleClientset(), "default", &corev1.Container{Name: "app", Image: tt.image}, arm64)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("platformRegistry.GetImageConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			var unavailable *registryUnavailableError
+			if got := errors.As(err, &unavailable); got != tt.wantUnavailable {
+				t.Errorf("platformRegistry.GetImageConfig() unavailable = %v, want %v", got, tt.wantUnavailable)
+			}
+			if got := len(fallback.pullPolicies) == 1; got != tt.wantFallback {
+				t.Errorf("platformRegistry.GetImageConfig() fell back = %v, want %v", got, tt.wantFallback)
+			}
+			if tt.wantFallback && fallback.pullPolicies[0] != corev1.PullAlways {
+				t.Errorf("platformRegistry.GetImageConfig() fell back with pull policy %v, want the wrapped cache bypassed", fallback.pullPolicies[0])
+			}
+		})
+	}
+}
+
+// fallbackRegistry records the pull policies it is asked for image configs with
+type fallbackRegistry struct {
+	pullPolicies []corev1.PullPolicy
+}
+
+func (r *fallbackRegistry) GetImageConfig(_ kubernetes.Interface, _ string, container *corev1.Container, _ *corev1.PodSpec) (*imagev1.ImageConfig, error) {
+	r.pullPolicies = append(r.pullPolicies, container.ImagePullPolicy)
+	return &imagev1.ImageConfig{Entrypoint: []string{"/app"}}, nil
+}
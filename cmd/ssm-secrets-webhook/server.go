@@ -0,0 +1,101 @@
+// Copyright © 2020 Peter Wilson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+func newServer(addr string, handler http.Handler, tlsConfig *tls.Config) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		TLSConfig:         tlsConfig,
+		ReadTimeout:       viper.GetDuration("server_read_timeout"),
+		ReadHeaderTimeout: viper.GetDuration("server_read_header_timeout"),
+		WriteTimeout:      viper.GetDuration("server_write_timeout"),
+		IdleTimeout:       viper.GetDuration("server_idle_timeout"),
+	}
+}
+
+func listenAndServe(server *http.Server) error {
+	if server.TLSConfig != nil {
+		return server.ListenAndServeTLS("", "")
+	}
+	return server.ListenAndServe()
+}
+
+func scheme(server *http.Server) string {
+	if server.TLSConfig != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// registerPprof serves the profiles behind the client certificate check, like the other
+// telemetry endpoints, as they expose the memory and command line of the webhook
+func registerPprof(mux *http.ServeMux, logger logrus.FieldLogger) {
+	mux.Handle("/debug/pprof/", requireClientCert(http.HandlerFunc(pprof.Index), logger))
+	mux.Handle("/debug/pprof/cmdline", requireClientCert(http.HandlerFunc(pprof.Cmdline), logger))
+	mux.Handle("/debug/pprof/profile", requireClientCert(http.HandlerFunc(pprof.Profile), logger))
+	mux.Handle("/debug/pprof/symbol", requireClientCert(http.HandlerFunc(pprof.Symbol), logger))
+	mux.Handle("/debug/pprof/trace", requireClientCert(http.HandlerFunc(pprof.Trace), logger))
+}
+
+// shutdownOnSignal blocks until SIGTERM or SIGINT and then shuts the servers down
+func shutdownOnSignal(logger logrus.FieldLogger, readiness *readinessChecker, servers ...*http.Server) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	shutdown(logger, <-signals, readiness, servers...)
+}
+
+// shutdown fails /readyz, waits shutdown_delay for the endpoints to be removed from the Service
+// and then drains the servers within shutdown_grace_period
+func shutdown(logger logrus.FieldLogger, sig os.Signal, readiness *readinessChecker, servers ...*http.Server) {
+	readiness.add("shutdown", func() error { return fmt.Errorf("received %s", sig) })
+
+	delay := viper.GetDuration("shutdown_delay")
+	logger.Infof("received %s, shutting down in %s", sig, delay)
+	time.Sleep(delay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), viper.GetDuration("shutdown_grace_period"))
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server *http.Server) {
+			defer wg.Done()
+			if err := server.Shutdown(ctx); err != nil {
+				logger.Errorf("error draining connections on %s: %s", server.Addr, err)
+			}
+		}(server)
+	}
+	wg.Wait()
+
+	logger.Info("shutdown complete")
+}
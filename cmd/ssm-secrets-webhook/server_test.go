@@ -0,0 +1,181 @@
+// Copyright © 2020 Peter Wilson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/spf13/viper"
+)
+
+func Test_newServer(t *testing.T) {
+	server := newServer(":8443", http.NotFoundHandler(), nil)
+
+	tests := []struct {
+		name string
+		got  time.Duration
+		want time.Duration
+	}{
+		{name: "read timeout", got: server.ReadTimeout, want: 15 * time.Second},
+		{name: "read header timeout", got: server.ReadHeaderTimeout, want: 5 * time.Second},
+		{name: "write timeout", got: server.WriteTimeout, want: 30 * time.Second},
+		{name: "idle timeout", got: server.IdleTimeout, want: 60 * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.got != tt.want {
+				t.Errorf("newServer() %s = %v, want %v", tt.name, tt.got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_registerPprof(t *testing.T) {
+	viper.Set("tls_verify_client_cert", true)
+	defer viper.Set("tls_verify_client_cert", false)
+
+	mux := http.NewServeMux()
+	registerPprof(mux, logrus.New())
+
+	for _, path := range []string{"/debug/pprof/", "/debug/pprof/cmdline", "/debug/pprof/profile", "/debug/pprof/symbol", "/debug/pprof/trace"} {
+		t.Run(path, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+			if rec.Code != http.StatusUnauthorized {
+				t.Errorf("registerPprof() %s status = %v, want %v", path, rec.Code, http.StatusUnauthorized)
+			}
+		})
+	}
+}
+
+// serveSlowly serves requests that block until release is closed
+func serveSlowly(t *testing.T, release chan struct{}) (server *http.Server, started chan struct{}, served chan error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started = make(chan struct{}, 1)
+	server = newServer(listener.Addr().String(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+		w.Write([]byte("done"))
+	}), nil)
+	served = make(chan error, 1)
+	go func() { served <- server.Serve(listener) }()
+	return server, started, served
+}
+
+func Test_shutdown(t *testing.T) {
+	viper.Set("shutdown_delay", "50ms")
+	defer viper.Set("shutdown_delay", "5s")
+
+	release := make(chan struct{})
+	server, started, served := serveSlowly(t, release)
+	responses := make(chan string, 1)
+	go func() {
+		resp, err := http.Get("http://" + server.Addr)
+		if err != nil {
+			responses <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		responses <- string(body)
+	}()
+	<-started
+
+	begin := time.Now()
+	done := make(chan struct{})
+	logger, _ := test.NewNullLogger()
+	readiness := newReadinessChecker(time.Second)
+	go func() {
+		shutdown(logger, syscall.SIGTERM, readiness, server)
+		close(done)
+	}()
+
+	// the endpoint is reported not ready while the listeners still accept connections
+	time.Sleep(10 * time.Millisecond)
+	rec := httptest.NewRecorder()
+	readiness.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("shutdown() readiness status during the shutdown delay = %v, want %v", rec.Code, http.StatusServiceUnavailable)
+	}
+
+	select {
+	case <-done:
+		t.Fatal("shutdown() returned with a request in flight")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown() didn't return once the request completed")
+	}
+	if elapsed := time.Since(begin); elapsed < 50*time.Millisecond {
+		t.Errorf("shutdown() returned after %v, want the shutdown delay first", elapsed)
+	}
+	if got := <-responses; got != "done" {
+		t.Errorf("shutdown() in flight request got %q, want it served", got)
+	}
+	if err := <-served; err != http.ErrServerClosed {
+		t.Errorf("shutdown() serve error = %v, want %v", err, http.ErrServerClosed)
+	}
+}
+
+func Test_shutdown_gracePeriod(t *testing.T) {
+	viper.Set("shutdown_delay", "0s")
+	viper.Set("shutdown_grace_period", "50ms")
+	defer viper.Set("shutdown_delay", "5s")
+	defer viper.Set("shutdown_grace_period", "30s")
+
+	release := make(chan struct{})
+	defer close(release)
+	server, started, _ := serveSlowly(t, release)
+	go http.Get("http://" + server.Addr)
+	<-started
+
+	logger, hook := test.NewNullLogger()
+	done := make(chan struct{})
+	go func() {
+		shutdown(logger, syscall.SIGTERM, newReadinessChecker(time.Second), server)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown() didn't return after the grace period")
+	}
+	errors := 0
+	for _, entry := range hook.AllEntries() {
+		if entry.Level == logrus.ErrorLevel {
+			errors++
+		}
+	}
+	if errors != 1 {
+		t.Errorf("shutdown() logged %d errors, want the request left in flight", errors)
+	}
+}
@@ -0,0 +1,360 @@
+// Copyright © 2020 Peter Wilson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/docker/distribution/reference"
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// reloadableSettings take effect on the next admission when the config file changes,
+// changes to any other setting are only applied on restart
+var reloadableSettings = map[string]bool{
+	"aws_region":                    true,
+	"ssm_env_image":                 true,
+	"ssm_env_image_pull_policy":     true,
+	"ssm_ignore_missing_secrets":    true,
+	"ssm_role_arn":                  true,
+	"ssm_file_mode":                 true,
+	"enable_json_log":               true,
+	"strict_entrypoint_resolution":  true,
+	"annotate_reference_paths":      true,
+	"image_entrypoint_mapping_file": true,
+	"configmap_failure_mode":        true,
+	"secret_failure_mode":           true,
+	"registry_failure_mode":         true,
+	"wrap_exec_handlers":            true,
+	"exec_handler_cache_ttl":        true,
+	"relative_path_template":        true,
+	"cluster_name":                  true,
+	"reference_prefix":              true,
+}
+
+// webhookSettings are the settings applied to admissions. A snapshot is replaced as a whole
+// on reload, so an admission never sees a partially applied config. Region, IgnoreMissingSecrets,
+// RoleARN, SsmEnvImage, FileMode and WrapExecHandlers can be overridden by namespace and pod annotations, the
+// lookup failure modes by namespace annotations only
+type webhookSettings struct {
+	Region                     string
+	SsmEnvImage                string
+	SsmEnvImagePullPolicy      corev1.PullPolicy
+	IgnoreMissingSecrets       bool
+	RoleARN                    string
+	FileMode                   bool
+	JSONLog                    bool
+	StrictEntrypointResolution bool
+	AnnotateReferencePaths     bool
+	ImageEntrypoints           []imageEntrypointMapping
+	ConfigMapFailureMode       failureMode
+	SecretFailureMode          failureMode
+	RegistryFailureMode        failureMode
+	WrapExecHandlers           bool
+	ExecHandlerCacheTTL        time.Duration
+	RelativePathTemplate       string
+	ClusterName                string
+	ReferencePrefix            referencePrefix
+
+	// set by the SsmInjectionPolicies matching the namespace
+	Policies            []string
+	AllowedPathPrefixes [][]string
+	FailureMode         failureMode
+	// FileModeForcedBy is the policy forcing file mode, variables can't opt out of it then
+	FileModeForcedBy string
+	// PolicyError is why the matching policies can't be applied, pods with references are
+	// failed with it according to FailureMode
+	PolicyError string
+}
+
+// newWebhookSettings validates the settings of v, defaultRegion is used when aws_region is empty
+func newWebhookSettings(v *viper.Viper, defaultRegion string) (*webhookSettings, error) {
+	settings := &webhookSettings{
+		Region:                v.GetString("aws_region"),
+		SsmEnvImage:           v.GetString("ssm_env_image"),
+		SsmEnvImagePullPolicy: corev1.PullPolicy(v.GetString("ssm_env_image_pull_policy")),
+		RoleARN:               v.GetString("ssm_role_arn"),
+		RelativePathTemplate:  v.GetString("relative_path_template"),
+		ClusterName:           v.GetString("cluster_name"),
+		ReferencePrefix:       referencePrefix(v.GetString("reference_prefix")),
+	}
+	if settings.Region == "" {
+		settings.Region = defaultRegion
+	}
+
+	if err := validateImage(settings.SsmEnvImage); err != nil {
+		return nil, fmt.Errorf("invalid ssm_env_image: %s", err)
+	}
+
+	if err := validateRoleARN(settings.RoleARN); err != nil {
+		return nil, fmt.Errorf("invalid ssm_role_arn: %s", err)
+	}
+
+	if err := validatePathTemplate(settings.RelativePathTemplate); err != nil {
+		return nil, fmt.Errorf("invalid relative_path_template: %s", err)
+	}
+	if strings.Contains(settings.RelativePathTemplate, "{cluster}") && settings.ClusterName == "" {
+		return nil, fmt.Errorf("relative_path_template uses {cluster} but cluster_name is empty")
+	}
+
+	if err := validateReferencePrefix(string(settings.ReferencePrefix)); err != nil {
+		return nil, fmt.Errorf("invalid reference_prefix: %s", err)
+	}
+
+	switch settings.SsmEnvImagePullPolicy {
+	case corev1.PullAlways, corev1.PullIfNotPresent, corev1.PullNever:
+	default:
+		return nil, fmt.Errorf("invalid ssm_env_image_pull_policy %q, expected one of Always, IfNotPresent, Never", settings.SsmEnvImagePullPolicy)
+	}
+
+	for key, value := range map[string]*bool{
+		"ssm_ignore_missing_secrets":   &settings.IgnoreMissingSecrets,
+		"ssm_file_mode":                &settings.FileMode,
+		"enable_json_log":              &settings.JSONLog,
+		"strict_entrypoint_resolution": &settings.StrictEntrypointResolution,
+		"annotate_reference_paths":     &settings.AnnotateReferencePaths,
+		"wrap_exec_handlers":           &settings.WrapExecHandlers,
+	} {
+		b, err := cast.ToBoolE(v.Get(key))
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q, expected true or false", key, v.GetString(key))
+		}
+		*value = b
+	}
+
+	ttl, err := cast.ToDurationE(v.Get("exec_handler_cache_ttl"))
+	if err != nil || ttl < 0 {
+		return nil, fmt.Errorf("invalid exec_handler_cache_ttl %q, expected a duration such as 30s", v.GetString("exec_handler_cache_ttl"))
+	}
+	settings.ExecHandlerCacheTTL = ttl
+
+	for key, value := range map[string]*failureMode{
+		"configmap_failure_mode": &settings.ConfigMapFailureMode,
+		"secret_failure_mode":    &settings.SecretFailureMode,
+		"registry_failure_mode":  &settings.RegistryFailureMode,
+	} {
+		mode, err := parseLookupFailureMode(v.GetString(key))
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %s", key, err)
+		}
+		*value = mode
+	}
+
+	settings.ImageEntrypoints, err = loadImageEntrypointMappings(v.GetString("image_entrypoint_mapping_file"))
+	if err != nil {
+		return nil, err
+	}
+
+	return settings, nil
+}
+
+func validateImage(image string) error {
+	if _, err := reference.ParseNormalizedNamed(image); err != nil {
+		return fmt.Errorf("%q is not a valid image reference: %s", image, err)
+	}
+	return nil
+}
+
+// validateRoleARN accepts an empty ARN, meaning ssm-env uses the pod credentials as they are
+func validateRoleARN(roleARN string) error {
+	if roleARN == "" {
+		return nil
+	}
+	parsed, err := arn.Parse(roleARN)
+	if err != nil {
+		return fmt.Errorf("%q is not a valid ARN: %s", roleARN, err)
+	}
+	if parsed.Service != "iam" || !strings.HasPrefix(parsed.Resource, "role/") {
+		return fmt.Errorf("%q is not an IAM role ARN", roleARN)
+	}
+	return nil
+}
+
+// currentSettings returns the settings snapshot of the webhook
+func (mw *mutatingWebhook) currentSettings() *webhookSettings {
+	if settings, ok := mw.settings.Load().(*webhookSettings); ok {
+		return settings
+	}
+	return &webhookSettings{}
+}
+
+// checkConfigFile rejects config files that aren't a flat map of known settings
+func checkConfigFile(file string, known map[string]bool) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("error reading config file %s: %s", file, err)
+	}
+
+	var settings map[string]interface{}
+	if err := yaml.UnmarshalStrict(data, &settings); err != nil {
+		return fmt.Errorf("error parsing config file %s: %s", file, err)
+	}
+
+	for key, value := range settings {
+		if !known[key] {
+			return fmt.Errorf("unknown setting %q in config file %s", key, file)
+		}
+		switch value.(type) {
+		case map[string]interface{}, []interface{}:
+			return fmt.Errorf("setting %q in config file %s must be a scalar", key, file)
+		}
+	}
+	return nil
+}
+
+// readConfigFile validates and reads the config file, settings from the environment take precedence.
+// The known settings are those with a default, they must be captured before reading the file
+func readConfigFile(file string, known map[string]bool) error {
+	if err := checkConfigFile(file, known); err != nil {
+		return err
+	}
+	viper.SetConfigFile(file)
+	if err := viper.ReadInConfig(); err != nil {
+		return fmt.Errorf("error reading config file %s: %s", file, err)
+	}
+	return nil
+}
+
+func knownSettings() map[string]bool {
+	known := map[string]bool{}
+	for _, key := range viper.AllKeys() {
+		known[key] = true
+	}
+	return known
+}
+
+// configWatcher applies changes of the config file to the webhook
+type configWatcher struct {
+	file          string
+	known         map[string]bool
+	defaultRegion string
+	restartOnly   map[string]string
+	apply         func(*webhookSettings)
+	logger        logrus.FieldLogger
+}
+
+func newConfigWatcher(file string, known map[string]bool, defaultRegion string, apply func(*webhookSettings), logger logrus.FieldLogger) *configWatcher {
+	restartOnly := map[string]string{}
+	for key := range known {
+		if !reloadableSettings[key] {
+			restartOnly[key] = viper.GetString(key)
+		}
+	}
+
+	return &configWatcher{
+		file:          filepath.Clean(file),
+		known:         known,
+		defaultRegion: defaultRegion,
+		restartOnly:   restartOnly,
+		apply:         apply,
+		logger:        logger,
+	}
+}
+
+// watch reloads the settings whenever the config file changes, which includes the symlink swap
+// of a mounted ConfigMap. The directory is watched, as the swap replaces the file
+func (w *configWatcher) watch() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := watcher.Add(filepath.Dir(w.file)); err != nil {
+		watcher.Close()
+		return err
+	}
+
+	realFile, _ := filepath.EvalSymlinks(w.file)
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				current, _ := filepath.EvalSymlinks(w.file)
+				written := filepath.Clean(event.Name) == w.file && event.Op&(fsnotify.Write|fsnotify.Create) != 0
+				if written || (current != "" && current != realFile) {
+					realFile = current
+					w.reload()
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				w.logger.Errorf("error watching config file %s: %s", w.file, err)
+			}
+		}
+	}()
+	return nil
+}
+
+func (w *configWatcher) reload() {
+	v, settings, err := w.load()
+	if err != nil {
+		configReloadsTotal.WithLabelValues("failure").Inc()
+		w.logger.Errorf("rejected config reload, keeping the last good config: %s", err)
+		return
+	}
+
+	var changed []string
+	for key, value := range w.restartOnly {
+		if v.GetString(key) != value {
+			changed = append(changed, key)
+		}
+	}
+	if len(changed) > 0 {
+		sort.Strings(changed)
+		w.logger.Warnf("config file changes to %s are only applied on restart", strings.Join(changed, ", "))
+	}
+
+	w.apply(settings)
+	configReloadsTotal.WithLabelValues("success").Inc()
+	w.logger.Infof("reloaded config file %s", w.file)
+}
+
+// load reads the config file into a private viper rather than the global one, which keeps the
+// startup config: a rejected change never takes effect, restart-only settings stay as they were,
+// and admissions never read settings while they are written
+func (w *configWatcher) load() (*viper.Viper, *webhookSettings, error) {
+	if err := checkConfigFile(w.file, w.known); err != nil {
+		return nil, nil, err
+	}
+
+	v := viper.New()
+	setDefaults(v)
+	v.AutomaticEnv()
+	v.SetConfigFile(w.file)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, nil, fmt.Errorf("error reading config file %s: %s", w.file, err)
+	}
+
+	settings, err := newWebhookSettings(v, w.defaultRegion)
+	if err != nil {
+		return nil, nil, err
+	}
+	return v, settings, nil
+}
@@ -0,0 +1,193 @@
+// Copyright © 2020 Peter Wilson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func Test_checkConfigFile(t *testing.T) {
+	known := map[string]bool{"ssm_env_image": true, "debug": true}
+
+	tests := []struct {
+		name    string
+		content string
+		wantErr bool
+	}{
+		{name: "valid", content: "ssm_env_image: pwillie/ssm-env:1.0.0\ndebug: true\n"},
+		{name: "empty", content: ""},
+		{name: "unknown setting", content: "ssm_env_imge: pwillie/ssm-env:1.0.0\n", wantErr: true},
+		{name: "nested setting", content: "ssm_env_image:\n  name: pwillie/ssm-env\n", wantErr: true},
+		{name: "duplicate setting", content: "debug: true\ndebug: false\n", wantErr: true},
+		{name: "invalid yaml", content: "debug: [\n", wantErr: true},
+	}
+
+	dir, err := ioutil.TempDir("", "settings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(dir, "config.yaml")
+			if err := ioutil.WriteFile(file, []byte(tt.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if err := checkConfigFile(file, known); (err != nil) != tt.wantErr {
+				t.Errorf("checkConfigFile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_configWatcher_reload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "settings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "config.yaml")
+	write := func(content string) {
+		if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer func() {
+		write("")
+		_ = viper.ReadInConfig()
+	}()
+
+	known := knownSettings()
+	write("ssm_env_image: pwillie/ssm-env:1.0.0\n")
+	if err := readConfigFile(file, known); err != nil {
+		t.Fatalf("readConfigFile() error = %v", err)
+	}
+
+	var applied *webhookSettings
+	watcher := newConfigWatcher(file, known, "ap-southeast-2", func(settings *webhookSettings) { applied = settings }, logrus.New())
+
+	tests := []struct {
+		name      string
+		content   string
+		wantImage string
+		wantPull  corev1.PullPolicy
+	}{
+		{
+			name:      "valid change is applied",
+			content:   "ssm_env_image: pwillie/ssm-env:1.1.0\nssm_env_image_pull_policy: Always\n",
+			wantImage: "pwillie/ssm-env:1.1.0",
+			wantPull:  corev1.PullAlways,
+		},
+		{
+			name:      "invalid pull policy keeps the last good config",
+			content:   "ssm_env_image: pwillie/ssm-env:1.2.0\nssm_env_image_pull_policy: Sometimes\n",
+			wantImage: "pwillie/ssm-env:1.1.0",
+			wantPull:  corev1.PullAlways,
+		},
+		{
+			name:      "invalid image keeps the last good config",
+			content:   "ssm_env_image: pwillie/SSM-ENV:1.2.0\n",
+			wantImage: "pwillie/ssm-env:1.1.0",
+			wantPull:  corev1.PullAlways,
+		},
+		{
+			name:      "unknown setting keeps the last good config",
+			content:   "ssm_env_image: pwillie/ssm-env:1.2.0\nssm_env_pull_policy: Never\n",
+			wantImage: "pwillie/ssm-env:1.1.0",
+			wantPull:  corev1.PullAlways,
+		},
+		{
+			name:      "recovers on the next valid change",
+			content:   "ssm_env_image: pwillie/ssm-env:1.2.0\n",
+			wantImage: "pwillie/ssm-env:1.2.0",
+			wantPull:  corev1.PullIfNotPresent,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			write(tt.content)
+			watcher.reload()
+
+			if applied == nil {
+				t.Fatalf("configWatcher.reload() applied no settings")
+			}
+			if applied.SsmEnvImage != tt.wantImage || applied.SsmEnvImagePullPolicy != tt.wantPull {
+				t.Errorf("configWatcher.reload() applied %s %s, want %s %s", applied.SsmEnvImage, applied.SsmEnvImagePullPolicy, tt.wantImage, tt.wantPull)
+			}
+			if got := viper.GetString("ssm_env_image"); got != "pwillie/ssm-env:1.0.0" {
+				t.Errorf("configWatcher.reload() changed the startup config to %s", got)
+			}
+		})
+	}
+}
+
+func Test_configWatcher_watch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "settings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a mounted ConfigMap swaps the ..data symlink the config file points to
+	for _, data := range []string{"v1", "v2"} {
+		if err := os.Mkdir(filepath.Join(dir, data), 0700); err != nil {
+			t.Fatal(err)
+		}
+		content := "ssm_env_image: pwillie/ssm-env:" + data + "\n"
+		if err := ioutil.WriteFile(filepath.Join(dir, data, "config.yaml"), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("v1", filepath.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "config.yaml")
+	if err := os.Symlink(filepath.Join("..data", "config.yaml"), file); err != nil {
+		t.Fatal(err)
+	}
+
+	applied := make(chan *webhookSettings, 10)
+	watcher := newConfigWatcher(file, knownSettings(), "ap-southeast-2", func(settings *webhookSettings) { applied <- settings }, logrus.New())
+	if err := watcher.watch(); err != nil {
+		t.Fatalf("configWatcher.watch() error = %v", err)
+	}
+
+	if err := os.Symlink("v2", filepath.Join(dir, "..data_tmp")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case settings := <-applied:
+		if settings.SsmEnvImage != "pwillie/ssm-env:v2" {
+			t.Errorf("configWatcher.watch() applied %s, want pwillie/ssm-env:v2", settings.SsmEnvImage)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("configWatcher.watch() applied no settings after the symlink swap")
+	}
+}
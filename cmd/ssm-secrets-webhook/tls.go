@@ -0,0 +1,253 @@
+// Copyright © 2020 Peter Wilson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+var tlsCertificateExpiry = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: metricsNamespace,
+	Name:      "tls_certificate_expiry_timestamp_seconds",
+	Help:      "Expiry of the serving certificate in seconds since the epoch.",
+})
+
+// keypairReloader serves the current certificate to the TLS listener, allowing it to be
+// swapped atomically without restarting the listener
+type keypairReloader struct {
+	certFile string
+	keyFile  string
+	cert     atomic.Value
+	logger   logrus.FieldLogger
+}
+
+func newKeypairReloader(certFile, keyFile string, logger logrus.FieldLogger) (*keypairReloader, error) {
+	r := &keypairReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		logger:   logger,
+	}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *keypairReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("error loading certificate %s and key %s: %s", r.certFile, r.keyFile, err)
+	}
+	return r.set(&cert)
+}
+
+func (r *keypairReloader) set(cert *tls.Certificate) error {
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("error parsing certificate: %s", err)
+	}
+	cert.Leaf = leaf
+
+	r.cert.Store(cert)
+	tlsCertificateExpiry.Set(float64(leaf.NotAfter.Unix()))
+	r.logger.Infof("loaded serving certificate valid until %s", leaf.NotAfter.Format(time.RFC3339))
+	return nil
+}
+
+func (r *keypairReloader) certificate() *tls.Certificate {
+	cert, _ := r.cert.Load().(*tls.Certificate)
+	return cert
+}
+
+// GetCertificate implements tls.Config.GetCertificate
+func (r *keypairReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert := r.certificate()
+	if cert == nil {
+		return nil, fmt.Errorf("no serving certificate loaded")
+	}
+	return cert, nil
+}
+
+// watch reloads the keypair whenever the files change. The parent directories are watched
+// as mounted Secrets are updated by swapping a symlink rather than writing the files.
+func (r *keypairReloader) watch() {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		r.logger.Errorf("error watching certificate files, certificate won't be reloaded: %s", err)
+		return
+	}
+	defer watcher.Close()
+
+	dirs := map[string]bool{filepath.Dir(r.certFile): true, filepath.Dir(r.keyFile): true}
+	for dir := range dirs {
+		if err := watcher.Add(dir); err != nil {
+			r.logger.Errorf("error watching %s, certificate won't be reloaded: %s", dir, err)
+			return
+		}
+	}
+
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Remove|fsnotify.Rename) == 0 {
+				continue
+			}
+			// a rotation touches several files, the keypair may be inconsistent until the last one
+			// lands so failures are only logged and retried on the next event
+			if err := r.reload(); err != nil {
+				r.logger.Warnf("error reloading certificate, keeping the current one: %s", err)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			r.logger.Errorf("error watching certificate files: %s", err)
+		}
+	}
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsCurves = map[string]tls.CurveID{
+	"P256":   tls.CurveP256,
+	"P384":   tls.CurveP384,
+	"P521":   tls.CurveP521,
+	"X25519": tls.X25519,
+}
+
+// newTLSConfig builds the listener TLS configuration from tls_min_version, tls_cipher_suites,
+// tls_curve_preferences and, when client certificates are verified, tls_client_ca_file
+func newTLSConfig(keypair *keypairReloader) (*tls.Config, error) {
+	config := &tls.Config{GetCertificate: keypair.GetCertificate}
+
+	minVersion, ok := tlsVersions[viper.GetString("tls_min_version")]
+	if !ok {
+		return nil, fmt.Errorf("invalid tls_min_version %q, expected one of 1.0, 1.1, 1.2, 1.3", viper.GetString("tls_min_version"))
+	}
+	config.MinVersion = minVersion
+
+	suites := map[string]uint16{}
+	for _, suite := range tls.CipherSuites() {
+		suites[suite.Name] = suite.ID
+	}
+	for _, name := range splitList(viper.GetString("tls_cipher_suites")) {
+		id, ok := suites[name]
+		if !ok {
+			return nil, fmt.Errorf("invalid or insecure cipher suite %q in tls_cipher_suites", name)
+		}
+		config.CipherSuites = append(config.CipherSuites, id)
+	}
+
+	for _, name := range splitList(viper.GetString("tls_curve_preferences")) {
+		curve, ok := tlsCurves[name]
+		if !ok {
+			return nil, fmt.Errorf("invalid curve %q in tls_curve_preferences, expected one of P256, P384, P521, X25519", name)
+		}
+		config.CurvePreferences = append(config.CurvePreferences, curve)
+	}
+
+	if viper.GetBool("tls_verify_client_cert") {
+		caFile := viper.GetString("tls_client_ca_file")
+		if caFile == "" {
+			return nil, fmt.Errorf("tls_client_ca_file is required when tls_verify_client_cert is enabled")
+		}
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading tls_client_ca_file: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in tls_client_ca_file %s", caFile)
+		}
+
+		// the handshake only verifies certificates when given so that kubelet probes of /healthz
+		// keep working, requireClientCert enforces them on the protected endpoints
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return config, nil
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// requireClientCert rejects requests without a verified client certificate when
+// tls_verify_client_cert is enabled, optionally restricted to tls_client_allowed_names
+func requireClientCert(handler http.Handler, logger logrus.FieldLogger) http.Handler {
+	if !viper.GetBool("tls_verify_client_cert") {
+		return handler
+	}
+
+	allowedNames := splitList(viper.GetString("tls_client_allowed_names"))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			logger.Warnf("rejected request to %s from %s without a verified client certificate", r.URL.Path, r.RemoteAddr)
+			http.Error(w, "client certificate required", http.StatusUnauthorized)
+			return
+		}
+
+		if len(allowedNames) > 0 && !clientCertAllowed(r.TLS.VerifiedChains[0][0], allowedNames) {
+			logger.Warnf("rejected request to %s from %s with client certificate %s", r.URL.Path, r.RemoteAddr, r.TLS.VerifiedChains[0][0].Subject.CommonName)
+			http.Error(w, "client certificate not allowed", http.StatusForbidden)
+			return
+		}
+
+		handler.ServeHTTP(w, r)
+	})
+}
+
+func clientCertAllowed(cert *x509.Certificate, allowedNames []string) bool {
+	for _, name := range allowedNames {
+		if cert.Subject.CommonName == name {
+			return true
+		}
+		for _, dnsName := range cert.DNSNames {
+			if dnsName == name {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,434 @@
+// Copyright © 2020 Peter Wilson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	certutil "k8s.io/client-go/util/cert"
+	"k8s.io/client-go/util/keyutil"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	serviceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+	caCertKey = "ca.crt"
+	caKeyKey  = "ca.key"
+)
+
+// tlsBootstrapper manages a self-signed CA and serving certificate stored in a Secret shared
+// by all replicas, and keeps the caBundle of the MutatingWebhookConfiguration in sync
+type tlsBootstrapper struct {
+	k8sClient         kubernetes.Interface
+	namespace         string
+	secretName        string
+	serviceName       string
+	webhookConfigName string
+	validity          time.Duration
+	caValidity        time.Duration
+	rotateBefore      time.Duration
+	logger            logrus.FieldLogger
+}
+
+// tlsMaterial is the content of the TLS Secret
+type tlsMaterial struct {
+	caCert   *x509.Certificate
+	caKey    crypto.Signer
+	caBundle []byte
+	cert     *x509.Certificate
+	certPEM  []byte
+	keyPEM   []byte
+}
+
+func newTLSBootstrapper(k8sClient kubernetes.Interface, logger logrus.FieldLogger) (*tlsBootstrapper, error) {
+	namespace := viper.GetString("tls_secret_namespace")
+	if namespace == "" {
+		var err error
+		if namespace, err = currentNamespace(); err != nil {
+			return nil, err
+		}
+	}
+
+	return &tlsBootstrapper{
+		k8sClient:         k8sClient,
+		namespace:         namespace,
+		secretName:        viper.GetString("tls_secret_name"),
+		serviceName:       viper.GetString("tls_service_name"),
+		webhookConfigName: viper.GetString("mutating_webhook_configuration_name"),
+		validity:          viper.GetDuration("tls_cert_validity"),
+		caValidity:        viper.GetDuration("tls_ca_validity"),
+		rotateBefore:      viper.GetDuration("tls_rotate_before"),
+		logger:            logger,
+	}, nil
+}
+
+func currentNamespace() (string, error) {
+	ns, err := ioutil.ReadFile(serviceAccountNamespaceFile)
+	if err != nil {
+		return "", fmt.Errorf("error reading namespace, set tls_secret_namespace explicitly: %s", err)
+	}
+	return strings.TrimSpace(string(ns)), nil
+}
+
+func (b *tlsBootstrapper) dnsNames() []string {
+	return []string{
+		b.serviceName,
+		fmt.Sprintf("%s.%s", b.serviceName, b.namespace),
+		fmt.Sprintf("%s.%s.svc", b.serviceName, b.namespace),
+		fmt.Sprintf("%s.%s.svc.cluster.local", b.serviceName, b.namespace),
+	}
+}
+
+// ensureCertificate returns the serving certificate from the Secret, creating or rotating
+// it first when required. Replicas racing on the Secret use whatever the winner stored, a
+// replica that lost the race reads the Secret again, a bounded number of times.
+func (b *tlsBootstrapper) ensureCertificate() (*tls.Certificate, *tlsMaterial, error) {
+	var material *tlsMaterial
+	err := retry.OnError(retry.DefaultRetry, func(err error) bool {
+		return apierrors.IsConflict(err) || apierrors.IsAlreadyExists(err)
+	}, func() (err error) {
+		material, err = b.storeCertificate()
+		return err
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("error storing tls secret %s/%s: %s", b.namespace, b.secretName, err)
+	}
+	return material.keypair()
+}
+
+// storeCertificate reads the Secret and stores new material in it when required, the errors
+// of creating or updating the Secret are returned as they are so that races can be retried
+func (b *tlsBootstrapper) storeCertificate() (*tlsMaterial, error) {
+	secrets := b.k8sClient.CoreV1().Secrets(b.namespace)
+
+	secret, err := secrets.Get(b.secretName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		material, err := b.generate(nil)
+		if err != nil {
+			return nil, err
+		}
+
+		secret = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: b.secretName, Namespace: b.namespace},
+			Type:       corev1.SecretTypeOpaque,
+		}
+		if err := material.encode(secret); err != nil {
+			return nil, err
+		}
+
+		if _, err := secrets.Create(secret); err != nil {
+			return nil, err
+		}
+		b.logger.Infof("created tls secret %s/%s", b.namespace, b.secretName)
+		return material, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading tls secret: %s", err)
+	}
+
+	material, err := decodeTLSMaterial(secret)
+	if err != nil {
+		b.logger.Warnf("tls secret %s/%s is invalid, regenerating: %s", b.namespace, b.secretName, err)
+		material = nil
+	}
+
+	switch {
+	case material == nil || b.needsRotation(material):
+		if material, err = b.generate(material); err != nil {
+			return nil, err
+		}
+		if err := material.encode(secret); err != nil {
+			return nil, err
+		}
+		if _, err := secrets.Update(secret); err != nil {
+			return nil, err
+		}
+		b.logger.Infof("rotated tls certificate in secret %s/%s", b.namespace, b.secretName)
+
+	case material.hasExpiredCAs(time.Now()):
+		if material.caBundle, err = pruneCABundle(material.caBundle, time.Now()); err != nil {
+			return nil, err
+		}
+		if err := material.encode(secret); err != nil {
+			return nil, err
+		}
+		if _, err := secrets.Update(secret); err != nil {
+			return nil, err
+		}
+		b.logger.Infof("removed expired CAs from tls secret %s/%s", b.namespace, b.secretName)
+	}
+
+	return material, nil
+}
+
+func (b *tlsBootstrapper) needsRotation(material *tlsMaterial) bool {
+	deadline := time.Now().Add(b.rotateBefore)
+	if material.cert.NotAfter.Before(deadline) || material.caCert.NotAfter.Before(deadline) {
+		return true
+	}
+	for _, name := range b.dnsNames() {
+		if material.cert.VerifyHostname(name) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// generate issues a new serving certificate, reusing the existing CA unless it is about to expire.
+// A replaced CA is kept in the bundle until it expires so in-flight certificates stay trusted,
+// expired CAs are dropped from it.
+func (b *tlsBootstrapper) generate(previous *tlsMaterial) (*tlsMaterial, error) {
+	now := time.Now()
+	material := &tlsMaterial{}
+
+	if previous != nil && previous.caCert.NotAfter.After(now.Add(b.rotateBefore)) {
+		material.caCert, material.caKey = previous.caCert, previous.caKey
+		var err error
+		if material.caBundle, err = pruneCABundle(previous.caBundle, now); err != nil {
+			return nil, err
+		}
+	} else {
+		caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		template := &x509.Certificate{
+			SerialNumber:          newSerialNumber(),
+			Subject:               pkix.Name{CommonName: fmt.Sprintf("%s-ca", b.serviceName)},
+			NotBefore:             now.Add(-5 * time.Minute),
+			NotAfter:              now.Add(b.caValidity),
+			KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, template, caKey.Public(), caKey)
+		if err != nil {
+			return nil, fmt.Errorf("error creating CA certificate: %s", err)
+		}
+		material.caCert, _ = x509.ParseCertificate(der)
+		material.caKey = caKey
+
+		bundle, err := certutil.EncodeCertificates(material.caCert)
+		if err != nil {
+			return nil, err
+		}
+		if previous != nil {
+			previousBundle, err := pruneCABundle(previous.caBundle, now)
+			if err != nil {
+				return nil, err
+			}
+			bundle = append(bundle, previousBundle...)
+		}
+		material.caBundle = bundle
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	notAfter := now.Add(b.validity)
+	if notAfter.After(material.caCert.NotAfter) {
+		notAfter = material.caCert.NotAfter
+	}
+	template := &x509.Certificate{
+		SerialNumber: newSerialNumber(),
+		Subject:      pkix.Name{CommonName: b.dnsNames()[2]},
+		DNSNames:     b.dnsNames(),
+		NotBefore:    now.Add(-5 * time.Minute),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, material.caCert, key.Public(), material.caKey)
+	if err != nil {
+		return nil, fmt.Errorf("error creating serving certificate: %s", err)
+	}
+	material.cert, _ = x509.ParseCertificate(der)
+	if material.certPEM, err = certutil.EncodeCertificates(material.cert); err != nil {
+		return nil, err
+	}
+	if material.keyPEM, err = keyutil.MarshalPrivateKeyToPEM(key); err != nil {
+		return nil, err
+	}
+
+	return material, nil
+}
+
+// pruneCABundle returns the certificates of the bundle that haven't expired
+func pruneCABundle(bundle []byte, now time.Time) ([]byte, error) {
+	certs, err := certutil.ParseCertsPEM(bundle)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %s", caCertKey, err)
+	}
+	var valid []*x509.Certificate
+	for _, cert := range certs {
+		if cert.NotAfter.After(now) {
+			valid = append(valid, cert)
+		}
+	}
+	if len(valid) == 0 {
+		return nil, nil
+	}
+	return certutil.EncodeCertificates(valid...)
+}
+
+// hasExpiredCAs reports whether the bundle holds CAs that expired
+func (m *tlsMaterial) hasExpiredCAs(now time.Time) bool {
+	certs, err := certutil.ParseCertsPEM(m.caBundle)
+	if err != nil {
+		return false
+	}
+	for _, cert := range certs {
+		if !cert.NotAfter.After(now) {
+			return true
+		}
+	}
+	return false
+}
+
+func newSerialNumber() *big.Int {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return big.NewInt(time.Now().UnixNano())
+	}
+	return serial
+}
+
+func (m *tlsMaterial) encode(secret *corev1.Secret) error {
+	caKeyPEM, err := keyutil.MarshalPrivateKeyToPEM(m.caKey)
+	if err != nil {
+		return err
+	}
+	secret.Data = map[string][]byte{
+		caCertKey:               m.caBundle,
+		caKeyKey:                caKeyPEM,
+		corev1.TLSCertKey:       m.certPEM,
+		corev1.TLSPrivateKeyKey: m.keyPEM,
+	}
+	return nil
+}
+
+func decodeTLSMaterial(secret *corev1.Secret) (*tlsMaterial, error) {
+	caCerts, err := certutil.ParseCertsPEM(secret.Data[caCertKey])
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %s", caCertKey, err)
+	}
+	caKey, err := keyutil.ParsePrivateKeyPEM(secret.Data[caKeyKey])
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %s", caKeyKey, err)
+	}
+	signer, ok := caKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("invalid %s: not a signing key", caKeyKey)
+	}
+	certs, err := certutil.ParseCertsPEM(secret.Data[corev1.TLSCertKey])
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %s", corev1.TLSCertKey, err)
+	}
+
+	return &tlsMaterial{
+		caCert:   caCerts[0],
+		caKey:    signer,
+		caBundle: secret.Data[caCertKey],
+		cert:     certs[0],
+		certPEM:  secret.Data[corev1.TLSCertKey],
+		keyPEM:   secret.Data[corev1.TLSPrivateKeyKey],
+	}, nil
+}
+
+func (m *tlsMaterial) keypair() (*tls.Certificate, *tlsMaterial, error) {
+	cert, err := tls.X509KeyPair(m.certPEM, m.keyPEM)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid tls keypair: %s", err)
+	}
+	return &cert, m, nil
+}
+
+// injectCABundle sets the caBundle of every webhook in the MutatingWebhookConfiguration
+func (b *tlsBootstrapper) injectCABundle(caBundle []byte) error {
+	configs := b.k8sClient.AdmissionregistrationV1().MutatingWebhookConfigurations()
+
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		config, err := configs.Get(b.webhookConfigName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		changed := false
+		for i := range config.Webhooks {
+			if !bytes.Equal(config.Webhooks[i].ClientConfig.CABundle, caBundle) {
+				config.Webhooks[i].ClientConfig.CABundle = caBundle
+				changed = true
+			}
+		}
+		if !changed {
+			return nil
+		}
+
+		if _, err := configs.Update(config); err != nil {
+			return err
+		}
+		b.logger.Infof("updated caBundle of mutatingwebhookconfiguration %s", b.webhookConfigName)
+		return nil
+	})
+}
+
+// bootstrap loads or creates the serving certificate and publishes its CA
+func (b *tlsBootstrapper) bootstrap(keypair *keypairReloader) error {
+	cert, material, err := b.ensureCertificate()
+	if err != nil {
+		return err
+	}
+	if err := b.injectCABundle(material.caBundle); err != nil {
+		return fmt.Errorf("error injecting caBundle into mutatingwebhookconfiguration %s: %s", b.webhookConfigName, err)
+	}
+
+	current := keypair.certificate()
+	if current == nil || !bytes.Equal(current.Certificate[0], cert.Certificate[0]) {
+		return keypair.set(cert)
+	}
+	return nil
+}
+
+// run periodically rotates the certificate and picks up rotations done by other replicas
+func (b *tlsBootstrapper) run(keypair *keypairReloader, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := b.bootstrap(keypair); err != nil {
+			b.logger.Errorf("error refreshing tls certificate: %s", err)
+		}
+	}
+}
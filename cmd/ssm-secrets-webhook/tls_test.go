@@ -0,0 +1,315 @@
+// Copyright © 2020 Peter Wilson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	fake "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/util/retry"
+)
+
+func writeTestKeypair(t *testing.T, dir string, notAfter time.Time) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "ssm-secrets-webhook"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func Test_keypairReloader_reload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssm-secrets-webhook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	first := time.Now().Add(time.Hour).Truncate(time.Second)
+	certFile, keyFile := writeTestKeypair(t, dir, first)
+
+	reloader, err := newKeypairReloader(certFile, keyFile, logrus.New())
+	if err != nil {
+		t.Fatalf("newKeypairReloader() error = %v", err)
+	}
+	cert, _ := reloader.GetCertificate(nil)
+	if !cert.Leaf.NotAfter.Equal(first) {
+		t.Errorf("GetCertificate() expiry = %v, want %v", cert.Leaf.NotAfter, first)
+	}
+
+	second := first.Add(24 * time.Hour)
+	writeTestKeypair(t, dir, second)
+	if err := reloader.reload(); err != nil {
+		t.Fatalf("reload() error = %v", err)
+	}
+	cert, _ = reloader.GetCertificate(nil)
+	if !cert.Leaf.NotAfter.Equal(second) {
+		t.Errorf("GetCertificate() expiry = %v, want %v", cert.Leaf.NotAfter, second)
+	}
+
+	// a broken keypair keeps the last good certificate
+	if err := ioutil.WriteFile(keyFile, []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloader.reload(); err == nil {
+		t.Errorf("reload() expected error for invalid key")
+	}
+	cert, _ = reloader.GetCertificate(nil)
+	if !cert.Leaf.NotAfter.Equal(second) {
+		t.Errorf("GetCertificate() expiry = %v, want %v", cert.Leaf.NotAfter, second)
+	}
+}
+
+func Test_tlsBootstrapper_bootstrap(t *testing.T) {
+	k8sClient := fake.NewSimpleClientset(&admissionregistrationv1.MutatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: "ssm-secrets-webhook"},
+		Webhooks:   []admissionregistrationv1.MutatingWebhook{{Name: "pods.ssm-secrets-webhook"}},
+	})
+	bootstrapper := newTestBootstrapper(k8sClient)
+
+	keypair := &keypairReloader{logger: logrus.New()}
+	if err := bootstrapper.bootstrap(keypair); err != nil {
+		t.Fatalf("bootstrap() error = %v", err)
+	}
+
+	cert := keypair.certificate()
+	if err := cert.Leaf.VerifyHostname("ssm-secrets-webhook.infra.svc"); err != nil {
+		t.Errorf("bootstrap() certificate = %v", err)
+	}
+
+	secret, err := k8sClient.CoreV1().Secrets("infra").Get("ssm-secrets-webhook-tls", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("bootstrap() secret error = %v", err)
+	}
+	config, err := k8sClient.AdmissionregistrationV1().MutatingWebhookConfigurations().Get("ssm-secrets-webhook", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(config.Webhooks[0].ClientConfig.CABundle, secret.Data[caCertKey]) {
+		t.Errorf("bootstrap() caBundle was not injected")
+	}
+
+	// a second replica reuses the stored certificate
+	other := &keypairReloader{logger: logrus.New()}
+	if err := bootstrapper.bootstrap(other); err != nil {
+		t.Fatalf("bootstrap() error = %v", err)
+	}
+	if !bytes.Equal(other.certificate().Certificate[0], cert.Certificate[0]) {
+		t.Errorf("bootstrap() generated a new certificate instead of reusing the secret")
+	}
+
+	// certificates close to expiry are rotated, keeping the CA
+	bootstrapper.rotateBefore = 48 * time.Hour
+	if err := bootstrapper.bootstrap(keypair); err != nil {
+		t.Fatalf("bootstrap() error = %v", err)
+	}
+	if bytes.Equal(keypair.certificate().Certificate[0], cert.Certificate[0]) {
+		t.Errorf("bootstrap() did not rotate the certificate")
+	}
+}
+
+func newTestBootstrapper(k8sClient *fake.Clientset) *tlsBootstrapper {
+	return &tlsBootstrapper{
+		k8sClient:         k8sClient,
+		namespace:         "infra",
+		secretName:        "ssm-secrets-webhook-tls",
+		serviceName:       "ssm-secrets-webhook",
+		webhookConfigName: "ssm-secrets-webhook",
+		validity:          24 * time.Hour,
+		caValidity:        240 * time.Hour,
+		rotateBefore:      time.Hour,
+		logger:            logrus.New(),
+	}
+}
+
+func Test_tlsBootstrapper_ensureCertificate_races(t *testing.T) {
+	tests := []struct {
+		name   string
+		verb   string
+		err    error
+		secret bool
+	}{
+		{name: "secret created by others", verb: "create", err: apierrors.NewAlreadyExists(corev1.Resource("secrets"), "ssm-secrets-webhook-tls")},
+		{name: "secret updated by others", verb: "update", err: apierrors.NewConflict(corev1.Resource("secrets"), "ssm-secrets-webhook-tls", nil), secret: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k8sClient := fake.NewSimpleClientset()
+			if tt.secret {
+				// an invalid secret is regenerated
+				_, _ = k8sClient.CoreV1().Secrets("infra").Create(&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "ssm-secrets-webhook-tls", Namespace: "infra"}})
+			}
+			attempts := 0
+			k8sClient.PrependReactor(tt.verb, "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				attempts++
+				return true, nil, tt.err
+			})
+
+			if _, _, err := newTestBootstrapper(k8sClient).ensureCertificate(); err == nil {
+				t.Errorf("ensureCertificate() error = nil, want the race lost")
+			}
+			if attempts != retry.DefaultRetry.Steps {
+				t.Errorf("ensureCertificate() attempts = %v, want %v", attempts, retry.DefaultRetry.Steps)
+			}
+		})
+	}
+}
+
+func Test_tlsBootstrapper_bootstrap_pruneCABundle(t *testing.T) {
+	k8sClient := fake.NewSimpleClientset(&admissionregistrationv1.MutatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: "ssm-secrets-webhook"},
+		Webhooks:   []admissionregistrationv1.MutatingWebhook{{Name: "pods.ssm-secrets-webhook"}},
+	})
+	bootstrapper := newTestBootstrapper(k8sClient)
+	keypair := &keypairReloader{logger: logrus.New()}
+	if err := bootstrapper.bootstrap(keypair); err != nil {
+		t.Fatalf("bootstrap() error = %v", err)
+	}
+
+	// a CA replaced earlier that has since expired
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	expiredFile, _ := writeTestKeypair(t, dir, time.Now().Add(-time.Minute))
+	expired, err := ioutil.ReadFile(expiredFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secrets := k8sClient.CoreV1().Secrets("infra")
+	secret, err := secrets.Get("ssm-secrets-webhook-tls", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	current := secret.Data[caCertKey]
+	secret.Data[caCertKey] = append(append([]byte(nil), current...), expired...)
+	if _, err := secrets.Update(secret); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := bootstrapper.bootstrap(keypair); err != nil {
+		t.Fatalf("bootstrap() error = %v", err)
+	}
+
+	secret, err = secrets.Get("ssm-secrets-webhook-tls", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(secret.Data[caCertKey], current) {
+		t.Errorf("bootstrap() kept the expired CA in the secret")
+	}
+	config, err := k8sClient.AdmissionregistrationV1().MutatingWebhookConfigurations().Get("ssm-secrets-webhook", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(config.Webhooks[0].ClientConfig.CABundle, current) {
+		t.Errorf("bootstrap() kept the expired CA in the caBundle")
+	}
+
+	// rotating the CA keeps the previous one, which hasn't expired
+	bootstrapper.rotateBefore = 480 * time.Hour
+	if err := bootstrapper.bootstrap(keypair); err != nil {
+		t.Fatalf("bootstrap() error = %v", err)
+	}
+	secret, err = secrets.Get("ssm-secrets-webhook-tls", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasSuffix(secret.Data[caCertKey], current) || bytes.Equal(secret.Data[caCertKey], current) {
+		t.Errorf("bootstrap() caBundle after rotating the CA = %s, want the new and the previous CA", secret.Data[caCertKey])
+	}
+}
+
+func Test_requireClientCert(t *testing.T) {
+	viper.Set("tls_verify_client_cert", true)
+	viper.Set("tls_client_allowed_names", "kube-apiserver")
+	defer viper.Set("tls_verify_client_cert", false)
+	defer viper.Set("tls_client_allowed_names", "")
+
+	handler := requireClientCert(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), logrus.New())
+
+	chain := func(cn string) *tls.ConnectionState {
+		return &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: cn}}}}}
+	}
+
+	tests := []struct {
+		name  string
+		state *tls.ConnectionState
+		want  int
+	}{
+		{name: "Will reject plain http", state: nil, want: http.StatusUnauthorized},
+		{name: "Will reject missing certificate", state: &tls.ConnectionState{}, want: http.StatusUnauthorized},
+		{name: "Will reject other clients", state: chain("someone"), want: http.StatusForbidden},
+		{name: "Will accept the api server", state: chain("kube-apiserver"), want: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/pods", nil)
+			req.TLS = tt.state
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("requireClientCert() status = %v, want %v", rec.Code, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,173 @@
+// Copyright © 2020 Peter Wilson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	imagev1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sirupsen/logrus"
+	whcontext "github.com/slok/kubewebhook/pkg/webhook/context"
+	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	fake "k8s.io/client-go/kubernetes/fake"
+)
+
+var (
+	recorderOnce sync.Once
+	recorder     *tracetest.SpanRecorder
+)
+
+// spanRecorder installs a tracer provider recording the spans of the package tracer, the global
+// provider is only picked up by it once
+func spanRecorder() *tracetest.SpanRecorder {
+	recorderOnce.Do(func() {
+		recorder = tracetest.NewSpanRecorder()
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+		otel.SetTextMapPropagator(propagation.TraceContext{})
+	})
+	return recorder
+}
+
+func Test_mutatingWebhook_ssmSecretsMutator_tracing(t *testing.T) {
+	recorder := spanRecorder()
+
+	tests := []struct {
+		name       string
+		namespace  string
+		registry   *MockRegistry
+		wantStatus codes.Code
+	}{
+		{name: "mutated", namespace: "traced", registry: &MockRegistry{Image: imagev1.ImageConfig{Entrypoint: []string{"/app"}}}, wantStatus: codes.Unset},
+		{name: "denied", namespace: "traced-denied", registry: &MockRegistry{Err: errors.New("cannot read imagePullSecret 'pull' in namespace 'traced-denied': not found")}, wantStatus: codes.Error},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mw := &mutatingWebhook{k8sClient: fake.NewSimpleClientset(), registry: tt.registry, logger: logrus.New()}
+			pod := &corev1.Pod{Spec: corev1.PodSpec{
+				SecurityContext: &corev1.PodSecurityContext{},
+				Containers:      []corev1.Container{{Name: "app", Image: "app", Env: []corev1.EnvVar{{Name: "DB_PASS", Value: "ssm:/db/pass"}}}},
+			}}
+
+			ctx := whcontext.SetAdmissionRequest(context.Background(), &admissionv1beta1.AdmissionRequest{UID: "1234", Namespace: tt.namespace})
+			_, _ = mw.ssmSecretsMutator(ctx, pod)
+
+			var span sdktrace.ReadOnlySpan
+			for _, s := range recorder.Ended() {
+				for _, attr := range s.Attributes() {
+					if s.Name() == "mutateContainers" && attr.Key == namespaceAttribute && attr.Value.AsString() == tt.namespace {
+						span = s
+					}
+				}
+			}
+			if span == nil {
+				t.Fatalf("ssmSecretsMutator() recorded no mutateContainers span for namespace %s", tt.namespace)
+			}
+			if got := span.Status().Code; got != tt.wantStatus {
+				t.Errorf("ssmSecretsMutator() mutateContainers span status = %v, want %v", got, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func Test_traceHandler(t *testing.T) {
+	spanRecorder()
+
+	var got trace.SpanContext
+	handler := traceHandler("admission", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = trace.SpanContextFromContext(r.Context())
+	}))
+
+	req := httptest.NewRequest(http.MethodPost, "/pods", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if got.TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" || got.SpanID().String() == "00f067aa0ba902b7" {
+		t.Errorf("traceHandler() span context = %v, %v, want a child of the traceparent", got.TraceID(), got.SpanID())
+	}
+}
+
+func Test_endSpan(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus codes.Code
+		wantEvents int
+	}{
+		{name: "success", wantStatus: codes.Unset},
+		{name: "error", err: errors.New("denied"), wantStatus: codes.Error, wantEvents: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := tracetest.NewSpanRecorder()
+			_, span := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("test").Start(context.Background(), "test")
+
+			endSpan(span, tt.err)
+
+			ended := recorder.Ended()
+			if len(ended) != 1 {
+				t.Fatalf("endSpan() ended %d spans, want 1", len(ended))
+			}
+			if got := ended[0].Status().Code; got != tt.wantStatus {
+				t.Errorf("endSpan() status = %v, want %v", got, tt.wantStatus)
+			}
+			if got := len(ended[0].Events()); got != tt.wantEvents {
+				t.Errorf("endSpan() events = %v, want %v", got, tt.wantEvents)
+			}
+		})
+	}
+}
+
+func Test_initTracing(t *testing.T) {
+	defer viper.Set("tracing_exporter", "")
+
+	tests := []struct {
+		name     string
+		exporter string
+		wantErr  bool
+	}{
+		{name: "disabled"},
+		{name: "unknown exporter", exporter: "jaeger", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			viper.Set("tracing_exporter", tt.exporter)
+			shutdown, err := initTracing(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("initTracing() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil {
+				if err := shutdown(context.Background()); err != nil {
+					t.Errorf("initTracing() shutdown error = %v", err)
+				}
+			}
+		})
+	}
+}